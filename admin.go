@@ -0,0 +1,284 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type RoomStatus struct {
+	Room    string   `json:"room"`    // The unique name of the room.
+	Locked  bool     `json:"locked"`  // Is the room refusing entry to new peers?
+	Members []string `json:"members"` // The ids of all the peers inside the room.
+}
+
+type PeerStatus struct {
+	Id            string    `json:"id"`            // The unique identifier of the peer.
+	Rooms         []string  `json:"rooms"`         // The names of all the rooms the peer is inside.
+	RemoteAddress string    `json:"remoteAddress"` // Where the peer is connecting from.
+	ConnectedAt   time.Time `json:"connectedAt"`   // When the peer's connection was opened.
+	Queued        int       `json:"queued"`        // The number of messages waiting to be written to the peer.
+	Disconnected  bool      `json:"disconnected"`  // Is the peer being held while it waits to resume?
+}
+
+type DrainStatus struct {
+	Draining    bool `json:"draining"`    // Are new connections being refused?
+	Connections int  `json:"connections"` // The number of connections still open.
+}
+
+type adminReply struct {
+	status int         // The HTTP status code to reply with.
+	body   interface{} // What to encode as JSON in the body of the reply.
+}
+
+// inSignalBox runs fn on the signalbox goroutine, so that admin requests see (and change)
+// the same consistent state as everything else.
+func inSignalBox(msg *mailbox, fn func(state SignalBox) (SignalBox, adminReply)) adminReply {
+	reply := make(chan adminReply, 1)
+
+	sent := msg.send(Message{nil, "", func(message ParsedMessage,
+		sourceSocket *Connection,
+		state SignalBox) (newState SignalBox, err error) {
+
+		state, r := fn(state)
+		reply <- r
+
+		return state, nil
+	}})
+	if !sent {
+		return adminReply{http.StatusServiceUnavailable, map[string]string{"error": "Signalbox has stopped"}}
+	}
+
+	return <-reply
+}
+
+func roomStatus(room *Room, state SignalBox) RoomStatus {
+	status := RoomStatus{room.Room, room.Locked, []string{}}
+	for id := range state.RoomContains[room.Room] {
+		status.Members = append(status.Members, id)
+	}
+	sort.Strings(status.Members)
+
+	return status
+}
+
+func peerStatus(peer *Peer, state SignalBox) PeerStatus {
+	status := PeerStatus{Id: peer.Id, Rooms: []string{}, Disconnected: peer.disconnected}
+	for r := range state.PeerIsIn[peer.Id] {
+		status.Rooms = append(status.Rooms, r)
+	}
+	sort.Strings(status.Rooms)
+
+	if peer.socket != nil {
+		status.RemoteAddress = peer.socket.remoteAddr
+		status.ConnectedAt = peer.socket.connectedAt
+		status.Queued = len(peer.socket.outbound)
+	}
+
+	return status
+}
+
+func listRooms(state SignalBox) (SignalBox, adminReply) {
+	rooms := []RoomStatus{}
+	for _, r := range state.Rooms {
+		rooms = append(rooms, roomStatus(r, state))
+	}
+	sort.Sort(byRoom(rooms))
+
+	return state, adminReply{http.StatusOK, rooms}
+}
+
+type byRoom []RoomStatus
+
+func (r byRoom) Len() int           { return len(r) }
+func (r byRoom) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byRoom) Less(i, j int) bool { return r[i].Room < r[j].Room }
+
+func showRoom(name string, state SignalBox) (SignalBox, adminReply) {
+	room, exists := state.Rooms[name]
+	if !exists {
+		return state, notFound("room", name)
+	}
+
+	return state, adminReply{http.StatusOK, roomStatus(room, state)}
+}
+
+func showPeer(id string, state SignalBox) (SignalBox, adminReply) {
+	peer, exists := state.Peers[id]
+	if !exists {
+		return state, notFound("peer", id)
+	}
+
+	return state, adminReply{http.StatusOK, peerStatus(peer, state)}
+}
+
+// kickPeer removes a peer from all of its rooms and closes its connection.
+func kickPeer(id string, state SignalBox) (SignalBox, adminReply) {
+	peer, exists := state.Peers[id]
+	if !exists {
+		return state, notFound("peer", id)
+	}
+
+	state.logger.Info("Kicking peer", "peer", id)
+	socket := peer.socket
+	state, err := leaveAllRooms(peer, state)
+	if err != nil {
+		state.logger.Error("Unable to tell everyone that the peer left", "peer", id, "err", err)
+	}
+	socket.Close()
+
+	return state, adminReply{http.StatusNoContent, nil}
+}
+
+// closeRoom removes every peer from a room, telling each of them that they have left, but
+// leaving their connections open.
+func closeRoom(name string, state SignalBox) (SignalBox, adminReply) {
+	room, exists := state.Rooms[name]
+	if !exists {
+		return state, notFound("room", name)
+	}
+
+	state.logger.Info("Closing room", "room", name)
+	rm := fmt.Sprintf("{\"room\":\"%s\"}", room.Room)
+	for _, p := range state.RoomContains[room.Room] {
+		leave := ParsedMessage{Command: "/leave", Peer: p.Id, Payload: rm}
+		if p.socket != nil && !p.disconnected {
+			if err := writeMessage(p.socket, leave.Parts()); err != nil {
+				state.logger.Error("Unable to tell the peer that it left", "peer", p.Id, "err", err)
+			}
+		}
+
+		var err error
+		state, err = removePeer(p, room, leave, state)
+		if err != nil {
+			state.logger.Error("Unable to tell everyone that the peer left", "peer", p.Id, "err", err)
+		}
+	}
+
+	return state, adminReply{http.StatusNoContent, nil}
+}
+
+func notFound(kind string, name string) adminReply {
+	return adminReply{http.StatusNotFound, map[string]string{"error": fmt.Sprintf("No %s named %s", kind, name)}}
+}
+
+func adminHandler(config Configuration, msg *mailbox, drainer *Drainer, logger *Logger) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeReply(w, adminReply{http.StatusOK, DrainStatus{drainer.isDraining(), drainer.open()}})
+
+		case "POST":
+			if !drainer.start() {
+				writeReply(w, adminReply{http.StatusConflict, map[string]string{"error": "Already draining"}})
+				return
+			}
+
+			go drainer.drain(context.Background())
+			writeReply(w, adminReply{http.StatusAccepted, nil})
+
+		case "DELETE":
+			drainer.stop()
+			writeReply(w, adminReply{http.StatusNoContent, nil})
+
+		default:
+			http.Error(w, "Method not allowed", 405)
+		}
+	})
+
+	mux.HandleFunc("/rooms", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+
+		writeReply(w, inSignalBox(msg, listRooms))
+	})
+
+	mux.HandleFunc("/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/rooms/")
+
+		switch r.Method {
+		case "GET":
+			writeReply(w, inSignalBox(msg, func(state SignalBox) (SignalBox, adminReply) {
+				return showRoom(name, state)
+			}))
+
+		case "DELETE":
+			writeReply(w, inSignalBox(msg, func(state SignalBox) (SignalBox, adminReply) {
+				return closeRoom(name, state)
+			}))
+
+		default:
+			http.Error(w, "Method not allowed", 405)
+		}
+	})
+
+	mux.HandleFunc("/peers/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/peers/")
+
+		switch r.Method {
+		case "GET":
+			writeReply(w, inSignalBox(msg, func(state SignalBox) (SignalBox, adminReply) {
+				return showPeer(id, state)
+			}))
+
+		case "DELETE":
+			writeReply(w, inSignalBox(msg, func(state SignalBox) (SignalBox, adminReply) {
+				return kickPeer(id, state)
+			}))
+
+		default:
+			http.Error(w, "Method not allowed", 405)
+		}
+	})
+
+	// Everything on the admin API requires the admin token.
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			logger.Warn("Unauthorised admin request", "remoteAddress", r.RemoteAddr)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeReply(w http.ResponseWriter, reply adminReply) {
+	if reply.body == nil {
+		w.WriteHeader(reply.status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(reply.status)
+	json.NewEncoder(w).Encode(reply.body)
+}
@@ -0,0 +1,446 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type AuthRequest struct {
+	Peer          string      // The id the peer is announcing as.
+	Room          string      // The room the peer is announcing into.
+	Announce      string      // The raw JSON the peer is announcing with.
+	Token         string      // The token the peer supplied, either in the announce or upgrade query string.
+	RemoteAddress string      // Where the peer is connecting from.
+	Header        http.Header // The headers of the request that opened the websocket.
+}
+
+// An Authenticator decides if a peer may announce into a room, it is consulted before the
+// announce reaches the signalbox.
+type Authenticator interface {
+	// Authenticate returns an error if the request should be refused. Authenticators may
+	// rewrite the Announce in the request, which is what gets forwarded to the signalbox.
+	Authenticate(request *AuthRequest) error
+}
+
+// Claims restrict which rooms and peer ids the bearer of a token may use. Each entry is
+// either exact, or ends in '*' to match anything starting with the rest of the entry.
+type Claims struct {
+	Rooms     []string `json:"rooms"` // The rooms the bearer may announce into, empty allows any room.
+	Peers     []string `json:"peers"` // The peer ids the bearer may announce as, empty allows any id.
+	Subject   string   `json:"sub"`   // A single peer id the bearer may announce as.
+	Expires   int64    `json:"exp"`   // When the token stops being valid (seconds since the epoch).
+	NotBefore int64    `json:"nbf"`   // When the token starts being valid (seconds since the epoch).
+}
+
+func (c Claims) permit(request *AuthRequest) error {
+	now := time.Now().Unix()
+	if c.Expires != 0 && now >= c.Expires {
+		return errors.New("Token has expired")
+	}
+
+	if c.NotBefore != 0 && now < c.NotBefore {
+		return errors.New("Token is not valid yet")
+	}
+
+	if !matchesAny(c.Rooms, request.Room) {
+		return errors.New(fmt.Sprintf("Token doesn't permit room %s", request.Room))
+	}
+
+	// The claims are shared by every socket presenting the token, so they are copied
+	// rather than appended to.
+	peers := c.Peers
+	if c.Subject != "" {
+		peers = append(append([]string{}, c.Peers...), c.Subject)
+	}
+
+	if !matchesAny(peers, request.Peer) {
+		return errors.New(fmt.Sprintf("Token doesn't permit peer %s", request.Peer))
+	}
+
+	return nil
+}
+
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, p := range patterns {
+		if matchesPattern(p, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesPattern returns true if value is pattern, or starts with a pattern ending in '*'.
+func matchesPattern(pattern string, value string) bool {
+	return pattern == value || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(value, pattern[:len(pattern)-1]))
+}
+
+// TokenFileAuthenticator accepts the static tokens listed in a JSON file, which maps each
+// token to the claims for that token.
+type TokenFileAuthenticator struct {
+	tokens map[string]Claims
+}
+
+func newTokenFileAuthenticator(file string) (*TokenFileAuthenticator, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &TokenFileAuthenticator{}
+	err = json.Unmarshal(b, &a.tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *TokenFileAuthenticator) Authenticate(request *AuthRequest) error {
+	for token, claims := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(request.Token)) == 1 {
+			return claims.permit(request)
+		}
+	}
+
+	return errors.New("Unknown token")
+}
+
+// JWTAuthenticator accepts JSON web tokens signed with either a shared HMAC secret, or the
+// private half of an RSA or ECDSA public key.
+type JWTAuthenticator struct {
+	secret    []byte           // The shared secret for HS256, HS384 and HS512 signed tokens.
+	publicKey crypto.PublicKey // The public key for RS* and ES* signed tokens.
+}
+
+func newJWTAuthenticator(secretFile string, publicKeyFile string) (*JWTAuthenticator, error) {
+	a := &JWTAuthenticator{}
+
+	if secretFile != "" {
+		secret, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return nil, err
+		}
+		a.secret = []byte(strings.TrimSpace(string(secret)))
+	}
+
+	if publicKeyFile != "" {
+		b, err := ioutil.ReadFile(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, errors.New(fmt.Sprintf("No PEM encoded key in %s", publicKeyFile))
+		}
+
+		a.publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(request *AuthRequest) error {
+	parts := strings.Split(request.Token, ".")
+	if len(parts) != 3 {
+		return errors.New("Token is not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return err
+	}
+
+	signature, err := decodeBase64(parts[2])
+	if err != nil {
+		return err
+	}
+
+	err = a.verify(header.Alg, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return err
+	}
+
+	var claims Claims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return err
+	}
+
+	return claims.permit(request)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := decodeBase64(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// decodeBase64 decodes the unpadded base64url encoding used by JWTs.
+func decodeBase64(s string) ([]byte, error) {
+	if m := len(s) % 4; m != 0 {
+		s += strings.Repeat("=", 4-m)
+	}
+
+	return base64.URLEncoding.DecodeString(s)
+}
+
+func (a *JWTAuthenticator) verify(alg string, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch {
+	case strings.HasSuffix(alg, "256"):
+		hash = crypto.SHA256
+	case strings.HasSuffix(alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(alg, "512"):
+		hash = crypto.SHA512
+	default:
+		return errors.New(fmt.Sprintf("Unsupported JWT algorithm %s", alg))
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	// Only accept the algorithm that matches the type of key, so a public key can never be
+	// used as an HMAC secret.
+	switch {
+	case strings.HasPrefix(alg, "HS") && a.secret != nil:
+		mac := hmac.New(hash.New, a.secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return errors.New("Invalid JWT signature")
+		}
+		return nil
+
+	case strings.HasPrefix(alg, "RS"):
+		if key, ok := a.publicKey.(*rsa.PublicKey); ok {
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		}
+
+	case strings.HasPrefix(alg, "ES"):
+		if key, ok := a.publicKey.(*ecdsa.PublicKey); ok {
+			size := (key.Params().BitSize + 7) / 8
+			if len(signature) != 2*size {
+				return errors.New("Invalid JWT signature")
+			}
+
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				return errors.New("Invalid JWT signature")
+			}
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("No key configured for JWT algorithm %s", alg))
+}
+
+// AnyAuthenticator accepts a request if any of its authenticators do.
+type AnyAuthenticator []Authenticator
+
+func (a AnyAuthenticator) Authenticate(request *AuthRequest) error {
+	err := errors.New("No authenticators configured")
+	for _, auth := range a {
+		err = auth.Authenticate(request)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// AllAuthenticator accepts a request only if all of its authenticators do, in order.
+type AllAuthenticator []Authenticator
+
+func (a AllAuthenticator) Authenticate(request *AuthRequest) error {
+	for _, auth := range a {
+		err := auth.Authenticate(request)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newAuthenticator builds the authenticator described by config, returning nil when peers
+// don't need to authenticate.
+func newAuthenticator(config Configuration, logger *Logger) (Authenticator, error) {
+	var tokens AnyAuthenticator
+
+	if config.AuthTokenFile != "" {
+		a, err := newTokenFileAuthenticator(config.AuthTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, a)
+	}
+
+	if config.AuthJWTSecretFile != "" || config.AuthJWTPublicKeyFile != "" {
+		a, err := newJWTAuthenticator(config.AuthJWTSecretFile, config.AuthJWTPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, a)
+	}
+
+	// Peers need a valid token before the webhook is asked about them.
+	var auths AllAuthenticator
+	if len(tokens) > 0 {
+		auths = append(auths, tokens)
+	}
+
+	if config.AuthWebhookURL != "" {
+		auths = append(auths, newWebhookAuthenticator(config, logger))
+	}
+
+	switch len(auths) {
+	case 0:
+		return nil, nil
+	case 1:
+		return auths[0], nil
+	}
+
+	return auths, nil
+}
+
+// authenticateAnnounce checks an announce received over c with auth, returning the message
+// to forward to the signalbox. Any token in the announce is stripped, so that it isn't
+// broadcast to everyone else in the room.
+func authenticateAnnounce(auth Authenticator, c *Connection, message ParsedMessage) (ParsedMessage, error) {
+	source, destination, err := ParsePeerAndRoom(message)
+	if err != nil {
+		return message, err
+	}
+
+	announce, token, err := stripToken(message.Payload)
+	if err != nil {
+		return message, err
+	}
+
+	request := AuthRequest{source.Id, destination.Room, message.Payload, "", c.remoteAddr, c.header}
+	if token != nil {
+		request.Token = *token
+		request.Announce = announce
+	} else if c.query != nil {
+		request.Token = c.query.Get("token")
+	}
+
+	err = auth.Authenticate(&request)
+	if err != nil {
+		return message, err
+	}
+
+	message.Payload = request.Announce
+	return message, nil
+}
+
+// stripToken removes the token from the JSON object announce, leaving everything else exactly
+// as the peer wrote it. The token is nil when the announce doesn't carry one.
+func stripToken(announce string) (string, *string, error) {
+	d := json.NewDecoder(strings.NewReader(announce))
+	if t, err := d.Token(); err != nil || t != json.Delim('{') {
+		return announce, nil, errors.New("Announce isn't a JSON object")
+	}
+
+	var token *string
+	var stripped []byte
+	kept := false // Has a field been kept ahead of the one being read?
+	from := 0     // Where the part of announce that hasn't been copied to stripped begins.
+
+	for d.More() {
+		// A removed token takes the comma before the next field with it.
+		start := int(d.InputOffset())
+		if start < from {
+			start = from
+		}
+
+		key, err := d.Token()
+		if err != nil {
+			return announce, nil, err
+		}
+
+		var value json.RawMessage
+		err = d.Decode(&value)
+		if err != nil {
+			return announce, nil, err
+		}
+		end := int(d.InputOffset())
+
+		var s string
+		if key != "token" || json.Unmarshal(value, &s) != nil {
+			kept = true
+			continue
+		}
+		token = &s
+
+		// Without a field ahead of the token, it is the comma after it that has to go.
+		if !kept {
+			rest := strings.TrimLeft(announce[end:], " \t\r\n")
+			if strings.HasPrefix(rest, ",") {
+				end = len(announce) - len(rest) + 1
+			}
+		}
+
+		stripped = append(stripped, announce[from:start]...)
+		from = end
+	}
+
+	if token == nil {
+		return announce, nil, nil
+	}
+
+	return string(append(stripped, announce[from:]...)), token, nil
+}
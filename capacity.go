@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"errors"
+	"sync"
+)
+
+type RoomLimit struct {
+	Room     string // The room name, or a prefix of room names ending in '*'.
+	MaxPeers int    // The number of peers allowed in matching rooms, zero is unlimited.
+}
+
+// maxPeersInRoom returns the number of peers allowed in room, the first matching RoomLimit
+// overrides MaxPeersPerRoom.
+func maxPeersInRoom(config Configuration, room string) int {
+	for _, l := range config.RoomLimits {
+		if matchesPattern(l.Room, room) {
+			return l.MaxPeers
+		}
+	}
+
+	return config.MaxPeersPerRoom
+}
+
+// ConnectionCounter keeps track of the open websockets, both in total and from each address.
+type ConnectionCounter struct {
+	lock      sync.Mutex
+	config    Configuration  // The connection caps to enforce.
+	total     int            // The number of open websockets.
+	addresses map[string]int // The number of open websockets from each address.
+}
+
+func newConnectionCounter(config Configuration) *ConnectionCounter {
+	return &ConnectionCounter{config: config, addresses: make(map[string]int)}
+}
+
+// configure updates the connection caps from config, which apply to the next websocket.
+func (c *ConnectionCounter) configure(config Configuration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.config = config
+}
+
+// open counts a new websocket from address, returning an error (and not counting it) if
+// either cap has been reached.
+func (c *ConnectionCounter) open(address string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.config.MaxConnections > 0 && c.total >= c.config.MaxConnections {
+		return errors.New("Too many connections to the signalbox")
+	}
+
+	if c.config.MaxConnectionsPerAddress > 0 && c.addresses[address] >= c.config.MaxConnectionsPerAddress {
+		return errors.New("Too many connections from your address")
+	}
+
+	c.total++
+	c.addresses[address]++
+	return nil
+}
+
+// close stops counting a websocket from address.
+func (c *ConnectionCounter) close(address string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.total--
+	c.addresses[address]--
+	if c.addresses[address] <= 0 {
+		delete(c.addresses, address)
+	}
+}
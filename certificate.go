@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the certificate and key files are checked for changes.
+const certificatePollInterval time.Duration = 30 * time.Second
+
+// CertificateReloader serves the certificate in CertFile and KeyFile, picking up a renewed
+// certificate without needing to restart (or drop any existing connections).
+type CertificateReloader struct {
+	lock     sync.RWMutex
+	certFile string           // The PEM encoded certificate (chain) to serve.
+	keyFile  string           // The PEM encoded private key for the certificate.
+	cert     *tls.Certificate // The most recently loaded certificate.
+	modified time.Time        // The most recent modification time of the certificate and key files.
+	logger   *Logger          // Where (re)loading the certificate is logged.
+}
+
+func newCertificateReloader(certFile string, keyFile string, logger *Logger) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reload loads the certificate from disk, keeping the previous certificate if it can't.
+func (r *CertificateReloader) reload() error {
+	modified, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	r.modified = modified
+
+	r.logger.Info("Loaded certificate", "file", r.certFile)
+	return nil
+}
+
+func (r *CertificateReloader) lastModified() (time.Time, error) {
+	var modified time.Time
+
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return modified, err
+		}
+
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+
+	return modified, nil
+}
+
+// changed returns true if the certificate or key file has been modified since it was loaded.
+func (r *CertificateReloader) changed() bool {
+	modified, err := r.lastModified()
+	if err != nil {
+		return false
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return !modified.Equal(r.modified)
+}
+
+func (r *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.cert, nil
+}
+
+// watch reloads the certificate whenever the certificate and key files change on disk, until
+// stop is closed.
+func (r *CertificateReloader) watch(stop chan struct{}) {
+	poll := time.NewTicker(certificatePollInterval)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-poll.C:
+		}
+
+		if !r.changed() {
+			continue
+		}
+
+		err := r.reload()
+		if err != nil {
+			r.logger.Error("Unable to reload certificate - keeping the old one", "file", r.certFile, "err", err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package client talks to a signalbox using the rtc.io signalling protocol, for bots and test
+// harnesses written in Go.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often a heartbeat is sent, keeping the connection inside the signalbox's SocketTimeout.
+const HeartbeatInterval time.Duration = 25 * time.Second
+
+// The number of events that can be waiting to be received.
+const eventQueueSize int = 64
+
+// Client is a single peer connected to a signalbox.
+type Client struct {
+	lock      sync.Mutex
+	id        string     // The id we announce ourselves with.
+	conn      Conn       // The connection to the signalbox.
+	events    chan Event // Events waiting to be received, closed with the connection.
+	announced []string   // The rooms we are waiting on a /roominfo (or /error) for, oldest first.
+	done      chan bool  // Closed once the connection has been closed.
+	once      sync.Once  // Ensures that the connection is only closed once.
+}
+
+// Dial opens a websocket to the signalbox at url (like ws://localhost:3000), and returns a
+// client that announces itself as id.
+func Dial(url string, id string) (*Client, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(newWebsocketConn(ws), id), nil
+}
+
+// New returns a client that talks to the signalbox over conn, announcing itself as id.
+func New(conn Conn, id string) *Client {
+	c := &Client{id: id,
+		conn:   conn,
+		events: make(chan Event, eventQueueSize),
+		done:   make(chan bool)}
+
+	go c.readPump()
+	go c.heartbeat()
+
+	return c
+}
+
+// Id returns the id the client announces itself with.
+func (c *Client) Id() string {
+	return c.id
+}
+
+// Events returns everything the signalbox tells the client, which is closed once the
+// connection is closed.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Handle calls handler with each event in turn, instead of receiving them from Events.
+func (c *Client) Handle(handler func(Event)) {
+	go func() {
+		for e := range c.events {
+			handler(e)
+		}
+	}()
+}
+
+func (c *Client) readPump() {
+	defer close(c.events)
+	defer c.Close()
+
+	for message := range c.conn.Messages() {
+		e, ok := parseEvent(message)
+		if !ok {
+			continue
+		}
+
+		// Replies to an announce don't name the room, but they arrive in the order the
+		// announces were sent.
+		if e.Type == RoomInfo || (e.Type == Error && e.Command == "/announce") {
+			e.Room = c.popAnnounced()
+		}
+
+		c.events <- e
+	}
+}
+
+// heartbeat sends primus pings until the connection is closed, the signalbox answers each
+// with a pong that is ignored.
+func (c *Client) heartbeat() {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+
+		case now := <-ticker.C:
+			c.conn.Send(fmt.Sprintf("primus::ping::%d", now.UnixNano()/int64(time.Millisecond)))
+		}
+	}
+}
+
+func (c *Client) popAnnounced() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.announced) == 0 {
+		return ""
+	}
+
+	room := c.announced[0]
+	c.announced = c.announced[1:]
+	return room
+}
+
+// send frames parts into a message. Only the last part may contain a "|", as the parts
+// before it are split apart by the signalbox. A Client receiving the message can't tell
+// where one arg ends and the next begins, so it sees the args as one.
+func (c *Client) send(parts ...string) error {
+	for _, p := range parts[:len(parts)-1] {
+		if strings.Contains(p, "|") {
+			return errors.New(fmt.Sprintf("Unable to send %q, it contains a '|'", p))
+		}
+	}
+
+	return c.conn.Send(strings.Join(parts, "|"))
+}
+
+// roomData is the JSON naming room, that announce, leave, lock and unlock are sent with.
+func roomData(room string, data map[string]interface{}) (string, error) {
+	d := map[string]interface{}{}
+	for k, v := range data {
+		d[k] = v
+	}
+	d["room"] = room
+
+	b, err := json.Marshal(d)
+	return string(b), err
+}
+
+// Announce joins room, telling everyone already there about us with data (which may be nil).
+// The reply arrives as a RoomInfo event (or an Error event if the announce was refused).
+func (c *Client) Announce(room string, data map[string]interface{}) error {
+	d, err := roomData(room, data)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.announced = append(c.announced, room)
+	c.lock.Unlock()
+
+	return c.send("/announce", c.id, d)
+}
+
+// Leave leaves room.
+func (c *Client) Leave(room string) error {
+	d, _ := roomData(room, nil)
+	return c.send("/leave", c.id, d)
+}
+
+// Lock stops new peers from announcing into room.
+func (c *Client) Lock(room string) error {
+	d, _ := roomData(room, nil)
+	return c.send("/lock", c.id, d)
+}
+
+// Unlock lets new peers announce into room again.
+func (c *Client) Unlock(room string) error {
+	d, _ := roomData(room, nil)
+	return c.send("/unlock", c.id, d)
+}
+
+// SendTo sends command (like "/offer") and args to just peer, which receives it as a
+// DirectMessage event from us.
+func (c *Client) SendTo(peer string, command string, args ...string) error {
+	err := checkCommand(command)
+	if err != nil {
+		return err
+	}
+
+	sender, _ := json.Marshal(map[string]string{"id": c.id})
+	return c.send(append([]string{"/to", peer, command, string(sender)}, args...)...)
+}
+
+// SendToMany sends command and args to each of peers in one message, who each receive it as
+// a DirectMessage event from us.
+func (c *Client) SendToMany(peers []string, command string, args ...string) error {
+	target, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+
+	return c.SendTo(string(target), command, args...)
+}
+
+// SendToMatching sends command and args to every peer whose announce data matches each field
+// of selector, like {"room": "talk", "role": "presenter"}. Without a "room", every room we
+// are in is searched.
+func (c *Client) SendToMatching(selector map[string]interface{}, command string, args ...string) error {
+	target, err := json.Marshal(selector)
+	if err != nil {
+		return err
+	}
+
+	return c.SendTo(string(target), command, args...)
+}
+
+// Send broadcasts command (like "/hello") and args to everyone in the rooms we are in, who
+// receive it as a CustomMessage event from us.
+func (c *Client) Send(command string, args ...string) error {
+	err := checkCommand(command)
+	if err != nil {
+		return err
+	}
+
+	return c.send(append([]string{command, c.id}, args...)...)
+}
+
+// SendRoom broadcasts command and args to just the peers in room (which we must be in).
+func (c *Client) SendRoom(room string, command string, args ...string) error {
+	err := checkCommand(command)
+	if err != nil {
+		return err
+	}
+
+	d, _ := roomData(room, nil)
+	return c.send(append([]string{command, c.id, d}, args...)...)
+}
+
+func checkCommand(command string) error {
+	if !strings.HasPrefix(command, "/") {
+		return errors.New(fmt.Sprintf("Unable to send %s, commands start with a '/'", command))
+	}
+
+	return nil
+}
+
+// Close hangs up on the signalbox, which tells everyone in our rooms that we have left.
+func (c *Client) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		err = c.conn.Close()
+	})
+
+	return err
+}
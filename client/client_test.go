@@ -0,0 +1,312 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package client
+
+import (
+	"context"
+	"github.com/cfreeman/signalbox"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Client Suite")
+}
+
+var _ = Describe("Client", func() {
+	var server *signalbox.Server
+
+	BeforeEach(func() {
+		server, _ = signalbox.NewServer(signalbox.DefaultConfiguration())
+	})
+
+	AfterEach(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		server.Shutdown(ctx)
+	})
+
+	connect := func(id string) *Client {
+		return New(server.Connect("127.0.0.1:0"), id)
+	}
+
+	next := func(c *Client) Event {
+		var e Event
+		Eventually(c.Events()).Should(Receive(&e))
+		return e
+	}
+
+	It("Should announce into rooms and hear about other peers", func() {
+		a := connect("a")
+		Ω(a.Announce("lobby", map[string]interface{}{"name": "Alice"})).Should(BeNil())
+
+		e := next(a)
+		Ω(e.Type).Should(Equal(RoomInfo))
+		Ω(e.Room).Should(Equal("lobby"))
+		Ω(e.RoomInfo.MemberCount).Should(Equal(1))
+
+		b := connect("b")
+		Ω(b.Announce("lobby", nil)).Should(BeNil())
+
+		e = next(b)
+		Ω(e.Type).Should(Equal(RoomInfo))
+		Ω(e.RoomInfo.MemberCount).Should(Equal(2))
+		Ω(e.RoomInfo.Members[0].Id).Should(Equal("a"))
+		Ω(string(e.RoomInfo.Members[0].Data)).Should(MatchJSON(`{"name":"Alice","room":"lobby"}`))
+
+		e = next(a)
+		Ω(e.Type).Should(Equal(PeerJoined))
+		Ω(e.Peer).Should(Equal("b"))
+		Ω(e.Room).Should(Equal("lobby"))
+
+		Ω(b.Leave("lobby")).Should(BeNil())
+		e = next(a)
+		Ω(e.Type).Should(Equal(PeerLeft))
+		Ω(e.Peer).Should(Equal("b"))
+		Ω(e.Room).Should(Equal("lobby"))
+	})
+
+	It("Should send direct and custom messages", func() {
+		a := connect("a")
+		a.Announce("chat", nil)
+		next(a)
+
+		b := connect("b")
+		b.Announce("chat", nil)
+		next(b)
+		next(a)
+
+		Ω(a.SendTo("b", "/offer", "sdp")).Should(BeNil())
+		e := next(b)
+		Ω(e.Type).Should(Equal(DirectMessage))
+		Ω(e.Peer).Should(Equal("a"))
+		Ω(e.Command).Should(Equal("/offer"))
+		Ω(e.Args).Should(Equal([]string{"sdp"}))
+
+		Ω(b.Send("/hello", "there")).Should(BeNil())
+		e = next(a)
+		Ω(e.Type).Should(Equal(CustomMessage))
+		Ω(e.Peer).Should(Equal("b"))
+		Ω(e.Command).Should(Equal("/hello"))
+		Ω(e.Args).Should(Equal([]string{"there"}))
+	})
+
+	It("Should send custom messages to a single room", func() {
+		a := connect("a")
+		a.Announce("one", nil)
+		next(a)
+		a.Announce("two", nil)
+		next(a)
+
+		b := connect("b")
+		b.Announce("one", nil)
+		next(b)
+		next(a)
+
+		Ω(a.SendRoom("one", "/hello", "there")).Should(BeNil())
+		e := next(b)
+		Ω(e.Type).Should(Equal(CustomMessage))
+		Ω(e.Room).Should(Equal("one"))
+		Ω(e.Args).Should(Equal([]string{"there"}))
+	})
+
+	It("Should refuse messages that would break the framing", func() {
+		a := connect("a")
+		Ω(a.Send("hello")).ShouldNot(BeNil())
+		Ω(a.SendTo("b", "/offer", "a|b", "sdp")).ShouldNot(BeNil())
+	})
+
+	It("Should announce data containing pipes", func() {
+		a := connect("a")
+		a.Announce("pipes", nil)
+		next(a)
+
+		b := connect("b")
+		Ω(b.Announce("pipes", map[string]interface{}{"name": "b|c"})).Should(BeNil())
+
+		e := next(a)
+		Ω(e.Type).Should(Equal(PeerJoined))
+		Ω(e.Room).Should(Equal("pipes"))
+		Ω(string(e.Data)).Should(MatchJSON(`{"name":"b|c","room":"pipes"}`))
+	})
+
+	It("Should send messages containing pipes", func() {
+		a := connect("a")
+		a.Announce("one", nil)
+		next(a)
+
+		b := connect("b")
+		b.Announce("one", nil)
+		next(b)
+		next(a)
+
+		Ω(a.SendTo("b", "/offer", "v=0|o=-")).Should(BeNil())
+		e := next(b)
+		Ω(e.Type).Should(Equal(DirectMessage))
+		Ω(e.Peer).Should(Equal("a"))
+		Ω(e.Args).Should(Equal([]string{"v=0|o=-"}))
+
+		Ω(b.Send("/hello", "x|y")).Should(BeNil())
+		e = next(a)
+		Ω(e.Type).Should(Equal(CustomMessage))
+		Ω(e.Peer).Should(Equal("b"))
+		Ω(e.Args).Should(Equal([]string{"x|y"}))
+
+		Ω(b.SendRoom("one", "/hello", "x|y")).Should(BeNil())
+		e = next(a)
+		Ω(e.Room).Should(Equal("one"))
+		Ω(e.Args).Should(Equal([]string{"x|y"}))
+	})
+
+	It("Should report refused announces against the room", func() {
+		a := connect("a")
+		a.Announce("private", nil)
+		next(a)
+		Ω(a.Lock("private")).Should(BeNil())
+
+		e := next(a)
+		Ω(e.Type).Should(Equal(RoomLocked))
+		Ω(e.Room).Should(Equal("private"))
+
+		b := connect("b")
+		b.Announce("private", nil)
+		e = next(b)
+		Ω(e.Type).Should(Equal(Error))
+		Ω(e.Command).Should(Equal("/announce"))
+		Ω(e.Room).Should(Equal("private"))
+		Ω(e.Message).Should(ContainSubstring("locked"))
+		Ω(e.Code).Should(Equal(signalbox.CodeRoomLocked))
+	})
+
+	It("Should close its events once the connection is closed", func() {
+		a := connect("a")
+		Ω(a.Close()).Should(BeNil())
+		Eventually(a.Events()).Should(BeClosed())
+	})
+
+	It("Should deliver events to a handler", func() {
+		a := connect("a")
+		events := make(chan Event, 1)
+		a.Handle(func(e Event) {
+			events <- e
+		})
+
+		a.Announce("handled", nil)
+		Eventually(events).Should(Receive())
+	})
+
+	It("Should dial signalbox over a websocket", func() {
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		a, err := Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "a")
+		Ω(err).Should(BeNil())
+		defer a.Close()
+
+		a.Announce("dialled", nil)
+		e := next(a)
+		Ω(e.Type).Should(Equal(RoomInfo))
+		Ω(e.Room).Should(Equal("dialled"))
+	})
+
+	It("Should parse reconnect hints", func() {
+		e, ok := parseEvent(`/reconnect|{"delay":250,"url":"wss://other.example.com"}`)
+		Ω(ok).Should(BeTrue())
+		Ω(e.Type).Should(Equal(Reconnect))
+		Ω(e.Reconnect).Should(Equal(signalbox.Reconnect{Delay: 250, URL: "wss://other.example.com"}))
+
+		_, ok = parseEvent(`"primus::pong::1234"`)
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("Should parse acknowledgements and the request ids of errors", func() {
+		e, ok := parseEvent(`/ack|{"id":"1","command":"/announce"}`)
+		Ω(ok).Should(BeTrue())
+		Ω(e.Type).Should(Equal(Ack))
+		Ω(e.Command).Should(Equal("/announce"))
+		Ω(e.RequestId).Should(Equal("1"))
+
+		e, ok = parseEvent(`/error|{"id":"2","code":"unknown-peer","command":"/to","message":"Unable to send 'to' message, peer z doesn't exist"}`)
+		Ω(ok).Should(BeTrue())
+		Ω(e.Type).Should(Equal(Error))
+		Ω(e.Code).Should(Equal(signalbox.CodeUnknownPeer))
+		Ω(e.RequestId).Should(Equal("2"))
+	})
+
+	It("Should send direct messages to many peers at once", func() {
+		a := connect("a")
+		a.Announce("many", map[string]interface{}{"role": "presenter"})
+		next(a)
+
+		b := connect("b")
+		b.Announce("many", map[string]interface{}{"role": "presenter"})
+		next(b)
+		next(a)
+
+		c := connect("c")
+		c.Announce("many", map[string]interface{}{"role": "viewer"})
+		next(c)
+		next(a)
+		next(b)
+
+		Ω(a.SendToMany([]string{"b", "c"}, "/offer")).Should(BeNil())
+		e := next(b)
+		Ω(e.Type).Should(Equal(DirectMessage))
+		Ω(e.Peer).Should(Equal("a"))
+		e = next(c)
+		Ω(e.Type).Should(Equal(DirectMessage))
+		Ω(e.Peer).Should(Equal("a"))
+
+		Ω(c.SendToMatching(map[string]interface{}{"room": "many", "role": "presenter"}, "/hello")).Should(BeNil())
+		e = next(a)
+		Ω(e.Command).Should(Equal("/hello"))
+		Ω(e.Peer).Should(Equal("c"))
+		e = next(b)
+		Ω(e.Command).Should(Equal("/hello"))
+		Ω(e.Peer).Should(Equal("c"))
+	})
+
+	It("Should report delivery receipts when asked for", func() {
+		a := connect("a")
+		a.Announce("receipts", map[string]interface{}{"receipts": true})
+		next(a)
+
+		b := connect("b")
+		b.Announce("receipts", nil)
+		next(b)
+		next(a)
+
+		Ω(a.SendTo("b", "/offer")).Should(BeNil())
+		e := next(a)
+		Ω(e.Type).Should(Equal(Receipt))
+		Ω(e.Peer).Should(Equal("b"))
+		Ω(e.Status).Should(Equal(signalbox.ReceiptDelivered))
+
+		Ω(a.SendTo("z", "/offer")).Should(BeNil())
+		e = next(a)
+		Ω(e.Type).Should(Equal(Receipt))
+		Ω(e.Peer).Should(Equal("z"))
+		Ω(e.Status).Should(Equal(signalbox.ReceiptUnknownPeer))
+	})
+})
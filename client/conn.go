@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package client
+
+import (
+	"github.com/gorilla/websocket"
+	"sync"
+)
+
+// Conn is the connection a Client talks to the signalbox over. A *signalbox.MemoryConn is a
+// Conn, so clients can run in the same process as the signalbox.
+type Conn interface {
+	Send(message string) error // Delivers message to the signalbox.
+	Messages() <-chan string   // The messages sent by the signalbox, closed with the connection.
+	Close() error              // Hangs up on the signalbox.
+}
+
+// websocketConn is a Conn over a gorilla websocket.
+type websocketConn struct {
+	lock     sync.Mutex
+	ws       *websocket.Conn // The websocket to the signalbox.
+	messages chan string     // Messages read from the websocket.
+}
+
+func newWebsocketConn(ws *websocket.Conn) *websocketConn {
+	c := &websocketConn{ws: ws, messages: make(chan string)}
+	go c.readPump()
+
+	return c
+}
+
+func (c *websocketConn) readPump() {
+	defer close(c.messages)
+
+	for {
+		_, message, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		c.messages <- string(message)
+	}
+}
+
+// Send writes message to the websocket, which only allows one writer at a time.
+func (c *websocketConn) Send(message string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.ws.WriteMessage(websocket.TextMessage, []byte(message))
+}
+
+func (c *websocketConn) Messages() <-chan string {
+	return c.messages
+}
+
+func (c *websocketConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	frame := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.ws.WriteMessage(websocket.CloseMessage, frame)
+
+	return c.ws.Close()
+}
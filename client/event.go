@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"github.com/cfreeman/signalbox"
+	"strings"
+)
+
+// EventType is the kind of thing the signalbox told a Client.
+type EventType string
+
+const (
+	PeerJoined    EventType = "peer-joined"    // A peer announced itself into one of our rooms.
+	PeerLeft      EventType = "peer-left"      // A peer left one of our rooms, or disconnected.
+	RoomInfo      EventType = "roominfo"       // The reply to our announce, listing who is already in the room.
+	DirectMessage EventType = "direct-message" // A message sent just to us with /to.
+	CustomMessage EventType = "custom-message" // A message broadcast to the rooms we share with the sender.
+	RoomLocked    EventType = "room-locked"    // One of our rooms has been locked.
+	RoomUnlocked  EventType = "room-unlocked"  // One of our rooms has been unlocked.
+	Error         EventType = "error"          // One of our commands failed.
+	Ack           EventType = "ack"            // A command we sent with a request id was handled.
+	Receipt       EventType = "receipt"        // What happened to a direct message we sent (when we asked for receipts).
+	Reconnect     EventType = "reconnect"      // The signalbox is draining, and we should reconnect.
+)
+
+type Event struct {
+	Type      EventType           // What happened.
+	Peer      string              // The peer the event is about, or that sent the message.
+	Room      string              // The room the event happened in, if any.
+	Command   string              // The command of a message, or the command that failed.
+	Args      []string            // The rest of a message after its command (and sender), which may contain pipes.
+	Data      json.RawMessage     // The JSON a peer announced itself with.
+	RoomInfo  signalbox.RoomInfo  // Who was in the room when we announced, for RoomInfo events.
+	Message   string              // Why the command failed, for Error events.
+	Code      string              // The machine-readable reason the command failed, for Error events.
+	RequestId string              // The request id of the command, for Ack, Error and Receipt events.
+	Status    string              // What happened to our direct message to Peer, for Receipt events.
+	Reconnect signalbox.Reconnect // When and where to reconnect, for Reconnect events.
+	Raw       string              // The message exactly as it was received.
+}
+
+// parseEvent converts a message from the signalbox into an Event, returning false for
+// messages that aren't events (like heartbeats).
+func parseEvent(message string) (Event, bool) {
+	e := Event{Raw: message}
+	if !strings.HasPrefix(message, "/") {
+		return e, false
+	}
+
+	parts := strings.Split(message, "|")
+	e.Command = parts[0]
+
+	switch parts[0] {
+	case "/announce", "/leave", "/lock", "/unlock":
+		// Only the command and peer are framed, the JSON after them may contain pipes.
+		parts = strings.SplitN(message, "|", 3)
+		if len(parts) < 3 {
+			return e, false
+		}
+
+		var room struct {
+			Room string `json:"room"`
+		}
+		json.Unmarshal([]byte(parts[2]), &room)
+
+		e.Peer = parts[1]
+		e.Room = room.Room
+		e.Data = json.RawMessage(parts[2])
+		e.Type = map[string]EventType{"/announce": PeerJoined,
+			"/leave":  PeerLeft,
+			"/lock":   RoomLocked,
+			"/unlock": RoomUnlocked}[parts[0]]
+
+	case "/roominfo":
+		e.Type = RoomInfo
+		json.Unmarshal([]byte(strings.Join(parts[1:], "|")), &e.RoomInfo)
+
+	case "/error":
+		var reply signalbox.ErrorReply
+		json.Unmarshal([]byte(strings.Join(parts[1:], "|")), &reply)
+
+		e.Type = Error
+		e.Command = reply.Command
+		e.Message = reply.Message
+		e.Code = reply.Code
+		e.RequestId = reply.Id
+
+	case "/ack":
+		var ack signalbox.Ack
+		json.Unmarshal([]byte(strings.Join(parts[1:], "|")), &ack)
+
+		e.Type = Ack
+		e.Command = ack.Command
+		e.RequestId = ack.Id
+
+	case "/receipt":
+		var receipt signalbox.Receipt
+		json.Unmarshal([]byte(strings.Join(parts[1:], "|")), &receipt)
+
+		e.Type = Receipt
+		e.Peer = receipt.To
+		e.Status = receipt.Status
+		e.RequestId = receipt.Id
+
+	case "/reconnect":
+		e.Type = Reconnect
+		json.Unmarshal([]byte(strings.Join(parts[1:], "|")), &e.Reconnect)
+
+	case "/to":
+		// /to|<us>|/<command>|<metadata>|<args>, where the metadata identifies the sender. The
+		// args run to the end of the message, as they may contain pipes of their own.
+		parts = strings.SplitN(message, "|", 5)
+		if len(parts) < 3 {
+			return e, false
+		}
+
+		e.Type = DirectMessage
+		e.Command = parts[2]
+		if len(parts) > 3 {
+			var sender struct {
+				Id string `json:"id"`
+			}
+			if json.Unmarshal([]byte(parts[3]), &sender) == nil {
+				e.Peer = sender.Id
+			}
+			e.Args = parts[4:]
+		}
+
+	default:
+		// /<command>|<sender>|<args>, where the args may contain pipes of their own.
+		parts = strings.SplitN(message, "|", 3)
+		e.Type = CustomMessage
+		if len(parts) > 1 {
+			e.Peer = parts[1]
+		}
+
+		if len(parts) > 2 {
+			// Messages sent to a single room name it before their args.
+			room, args, named := splitRoom(parts[2])
+			if named {
+				e.Room = room
+				e.Args = args
+			} else {
+				e.Args = parts[2:]
+			}
+		}
+	}
+
+	return e, true
+}
+
+// splitRoom decodes the JSON naming a room from the front of args, returning the args that
+// follow it.
+func splitRoom(args string) (string, []string, bool) {
+	var room struct {
+		Room string `json:"room"`
+	}
+
+	d := json.NewDecoder(strings.NewReader(args))
+	if d.Decode(&room) != nil || room.Room == "" {
+		return "", nil, false
+	}
+
+	n := int(d.InputOffset())
+	switch {
+	case n == len(args):
+		return room.Room, nil, true
+
+	case args[n] == '|':
+		return room.Room, []string{args[n+1:]}, true
+	}
+
+	return "", nil, false
+}
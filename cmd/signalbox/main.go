@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Command signalbox serves the signalbox on its own, configured from a file, SIGNALBOX_*
+// environment variables and the command line.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/cfreeman/signalbox"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How often the configuration file is checked for changes, when ReloadOnChange is set.
+const configPollInterval time.Duration = 5 * time.Second
+
+// How long connections have to close once the drain has finished.
+const shutdownGrace time.Duration = 5 * time.Second
+
+func main() {
+	err := run(os.Args[1:], os.Environ())
+	if err != nil {
+		log.Printf("Unable to start SignalBox: %s", err)
+		os.Exit(1)
+	}
+}
+
+// run starts signalbox with the command line args and environment variables environ, returning
+// once it has been shut down.
+func run(args []string, environ []string) error {
+	options, err := signalbox.ParseOptions(args)
+	if err == flag.ErrHelp {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	config, err := signalbox.LoadConfiguration(options, environ)
+	if err != nil {
+		return err
+	}
+
+	if options.PrintConfig {
+		fmt.Print(signalbox.FormatConfiguration(config))
+		return nil
+	}
+
+	// Catch SIGHUP before starting, so one sent while the server starts up can't kill it.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	server, err := signalbox.NewServer(config)
+	if err != nil {
+		return err
+	}
+
+	err = server.Start()
+	if err != nil {
+		return err
+	}
+
+	go watchConfiguration(server, hup, options, environ, config)
+
+	// Drain and exit when asked to terminate, a second signal exits straight away.
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
+	go func() {
+		<-sig
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.DrainTimeout)+shutdownGrace)
+	defer cancel()
+
+	return server.Shutdown(ctx)
+}
+
+func lastModified(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// watchConfiguration reloads the configuration (layered as it was at startup) whenever hup
+// receives a SIGHUP, or the file changes on disk when ReloadOnChange is set.
+func watchConfiguration(server *signalbox.Server, hup chan os.Signal, options signalbox.Options, environ []string, config signalbox.Configuration) {
+	poll := time.NewTicker(configPollInterval)
+	modified := lastModified(options.ConfigFile)
+
+	for {
+		select {
+		case <-hup:
+		case <-poll.C:
+			if !config.ReloadOnChange || lastModified(options.ConfigFile).Equal(modified) {
+				continue
+			}
+		}
+		modified = lastModified(options.ConfigFile)
+
+		updated, err := signalbox.LoadConfiguration(options, environ)
+		if err == nil {
+			err = server.Reload(updated)
+		}
+
+		if err != nil {
+			server.Logger().Error("Unable to reload configuration - keeping the current one", "file", options.ConfigFile, "err", err)
+			continue
+		}
+		config = updated
+	}
+}
@@ -17,34 +17,245 @@
  * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
  */
 
-package main
+package signalbox
 
 import (
+	"bytes"
 	"encoding/json"
-	"os"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Configuration struct {
-	ListenAddress string
-	SocketTimeout time.Duration
+	ListenAddress            string      // The address that signalbox listens on for websocket connections.
+	SocketTimeout            Duration    // How long a socket may be idle, or a write may take.
+	OutboundQueueSize        int         // The number of messages that can be waiting to be written to a peer.
+	OutboundQueuePolicy      string      // What to do when a peer falls behind: drop-oldest, drop-newest or disconnect.
+	ReconnectWindow          Duration    // How long a dropped peer has to resume, zero disables resuming.
+	AdminAddress             string      // The address the admin API listens on, empty disables the admin API.
+	AdminToken               string      // The bearer token required for every request to the admin API.
+	LogLevel                 string      // The lowest level that is logged: debug, info, warn or error.
+	LogFormat                string      // How each log line is written: text or json.
+	LogPayloads              string      // How the contents of messages are logged: off, redacted or full.
+	CertFile                 string      // The PEM encoded certificate to serve wss:// with, empty serves ws://.
+	KeyFile                  string      // The PEM encoded private key for CertFile.
+	AllowedOrigins           []string    // The origins websockets may be opened from, empty allows any origin.
+	AuthTokenFile            string      // A JSON file of static tokens peers may announce with, mapped to their claims.
+	AuthJWTSecretFile        string      // The shared secret for verifying HMAC signed JWTs.
+	AuthJWTPublicKeyFile     string      // The PEM encoded RSA or ECDSA public key for verifying signed JWTs.
+	AuthWebhookURL           string      // Where announces are POSTed for an allow, deny or modify decision.
+	AuthWebhookTimeout       Duration    // How long the webhook has to make a decision.
+	AuthWebhookCacheTTL      Duration    // How long a decision is cached for, zero disables caching.
+	AuthWebhookFailOpen      bool        // Allow announces when the webhook fails, rather than denying them.
+	SocketAnnounceLimit      RateLimit   // The rate each socket may announce and resume at.
+	SocketRelayLimit         RateLimit   // The rate each socket may send everything else at.
+	AddressAnnounceLimit     RateLimit   // The rate all the sockets from an address may announce and resume at.
+	AddressRelayLimit        RateLimit   // The rate all the sockets from an address may send everything else at.
+	BanDuration              Duration    // How long a repeat offender against the limits is banned for, doubling for each offence.
+	MaxBanDuration           Duration    // The longest a ban can last, zero leaves bans uncapped.
+	MaxConnections           int         // The number of websockets that may be open at once, zero is unlimited.
+	MaxConnectionsPerAddress int         // The number of websockets that may be open from each address, zero is unlimited.
+	MaxPeersPerRoom          int         // The number of peers allowed in each room, zero is unlimited.
+	RoomLimits               []RoomLimit // Overrides MaxPeersPerRoom for rooms matching a name or prefix.
+	MaxRoomsPerPeer          int         // The number of rooms each peer may be inside, zero is unlimited.
+	DrainTimeout             Duration    // How long to wait for rooms to empty when draining.
+	DrainReconnectHint       bool        // Tell peers to reconnect when draining.
+	DrainReconnectURL        string      // Where peers are told to reconnect to, empty reconnects to the same address.
+	DrainReconnectJitter     Duration    // How long to spread reconnecting peers over.
+	ReloadOnChange           bool        // Reload the configuration whenever this file changes, as well as on SIGHUP.
 }
 
+// Duration is a time.Duration written in the configuration as either a string ("30s",
+// "1m30s") or a bare number of seconds.
+type Duration time.Duration
+
+func (d *Duration) parse(s string) error {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid duration %q", s))
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) != nil {
+		s = string(b)
+	}
+
+	return d.parse(s)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DefaultConfiguration returns the settings signalbox uses when nothing else is configured.
+func DefaultConfiguration() Configuration {
+	return Configuration{ListenAddress: ":3000",
+		SocketTimeout:       Duration(300 * time.Second),
+		OutboundQueueSize:   256,
+		OutboundQueuePolicy: Disconnect,
+		LogLevel:            "info",
+		LogFormat:           "text",
+		LogPayloads:         PayloadsOff,
+		AuthWebhookTimeout:  Duration(5 * time.Second),
+		BanDuration:         Duration(time.Minute),
+		MaxBanDuration:      Duration(time.Hour),
+		DrainTimeout:        Duration(30 * time.Second)}
+}
+
+// parseConfiguration reads configFile over the defaults. Unknown settings are an error, so
+// that a typo isn't silently ignored.
 func parseConfiguration(configFile string) (configuration Configuration, err error) {
-	config := Configuration{":3000", 300}
+	config := DefaultConfiguration()
 
-	// Open the configuration file.
-	file, err := os.Open(configFile)
+	b, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return config, err
 	}
 
-	// Parse JSON in the configuration file.
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
+	err = decodeStrict(b, &config)
 	if err != nil {
-		return config, err
+		return config, errors.New(fmt.Sprintf("%s: %s", configFile, err))
 	}
 
 	return config, nil
 }
+
+// decodeStrict decodes the JSON in b into v, refusing any keys that v doesn't have.
+func decodeStrict(b []byte, v interface{}) error {
+	err := checkKeys(b, reflect.TypeOf(v).Elem(), "")
+	if err != nil {
+		return err
+	}
+
+	return json.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+func checkKeys(b []byte, t reflect.Type, path string) error {
+	switch t.Kind() {
+	case reflect.Struct:
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(b, &fields) != nil {
+			return nil // Let the decoder report the mismatch.
+		}
+
+		for k, v := range fields {
+			f, exists := t.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, k) })
+			if !exists {
+				return errors.New(fmt.Sprintf("Unknown setting %s%s", path, k))
+			}
+
+			err := checkKeys(v, f.Type, path+f.Name+".")
+			if err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice:
+		var elements []json.RawMessage
+		if json.Unmarshal(b, &elements) != nil {
+			return nil
+		}
+
+		for i, e := range elements {
+			err := checkKeys(e, t.Elem(), fmt.Sprintf("%s%d.", path, i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validate returns an error describing every invalid setting in the configuration.
+func (c Configuration) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.ListenAddress != "", "ListenAddress must be set")
+	check(c.SocketTimeout > 0, "SocketTimeout must be positive")
+	check(c.OutboundQueueSize > 0, "OutboundQueueSize must be positive")
+	check(oneOf(c.OutboundQueuePolicy, DropOldest, DropNewest, Disconnect),
+		"OutboundQueuePolicy must be %s, %s or %s", DropOldest, DropNewest, Disconnect)
+	check(oneOf(strings.ToUpper(c.LogLevel), levelNames...), "LogLevel must be debug, info, warn or error")
+	check(oneOf(strings.ToLower(c.LogFormat), "text", "json"), "LogFormat must be text or json")
+	check(oneOf(c.LogPayloads, PayloadsOff, PayloadsRedacted, PayloadsFull), "LogPayloads must be off, redacted or full")
+	check((c.CertFile == "") == (c.KeyFile == ""), "CertFile and KeyFile must be set together")
+	check(c.AdminAddress == "" || c.AdminToken != "", "AdminToken must be set to serve the admin API")
+	check(c.AuthWebhookURL == "" || c.AuthWebhookTimeout > 0, "AuthWebhookTimeout must be positive")
+	check(absoluteURL(c.AuthWebhookURL), "AuthWebhookURL must be an absolute URL")
+	check(absoluteURL(c.DrainReconnectURL), "DrainReconnectURL must be an absolute URL")
+
+	for _, o := range c.AllowedOrigins {
+		check(o != "", "AllowedOrigins can't contain an empty origin")
+	}
+
+	for _, l := range c.RoomLimits {
+		check(l.Room != "", "RoomLimits must each have a Room")
+		check(l.MaxPeers >= 0, "RoomLimits can't have a negative MaxPeers")
+	}
+
+	// Nothing else can be negative.
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		f := v.Field(i)
+
+		switch f.Kind() {
+		case reflect.Int, reflect.Int64:
+			check(f.Int() >= 0, "%s can't be negative", name)
+
+		case reflect.Struct:
+			for j := 0; j < f.NumField(); j++ {
+				if f.Field(j).Kind() == reflect.Float64 {
+					check(f.Field(j).Float() >= 0, "%s.%s can't be negative", name, f.Type().Field(j).Name)
+				}
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+
+	return false
+}
+
+func absoluteURL(s string) bool {
+	if s == "" {
+		return true
+	}
+
+	u, err := url.Parse(s)
+	return err == nil && u.IsAbs() && u.Host != ""
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The policies that can be applied when the outbound queue of a connection is full.
+const (
+	DropOldest string = "drop-oldest" // Discard the oldest queued message to make room.
+	DropNewest string = "drop-newest" // Discard the message being written.
+	Disconnect string = "disconnect"  // Close the connection to the peer that has fallen behind.
+)
+
+type Connection struct {
+	socket      Transport     // The transport that messages are written to.
+	id          string        // The id of the peer bound to this connection by its first announce.
+	remoteAddr  string        // Where the connection was opened from.
+	connectedAt time.Time     // When the connection was opened.
+	header      http.Header   // The headers of the request that opened the connection.
+	query       url.Values    // The query string of the request that opened the connection.
+	outbound    chan []byte   // Messages waiting to be written to the socket.
+	closed      chan bool     // Closed when the connection has been shut down.
+	once        sync.Once     // Ensures that the connection is only shut down once.
+	final       []byte        // The last message written to the socket before it is closed.
+	closeCode   int           // The status code of the close frame sent when the connection is closed.
+	closeReason string        // The reason given in the close frame.
+	policy      string        // The policy to apply when the outbound queue is full.
+	timeout     time.Duration // How long a single write to the socket may take.
+	logger      *Logger       // Where problems with the connection are logged.
+	metrics     *Metrics      // Where traffic across the connection is counted.
+}
+
+func newConnection(config Configuration, t Transport) *Connection {
+	size := config.OutboundQueueSize
+	if size < 1 {
+		size = 1
+	}
+
+	c := &Connection{socket: t,
+		connectedAt: time.Now(),
+		outbound:    make(chan []byte, size),
+		closed:      make(chan bool),
+		policy:      config.OutboundQueuePolicy,
+		timeout:     time.Duration(config.SocketTimeout),
+		logger:      defaultLogger,
+		metrics:     defaultMetrics}
+
+	if t != nil {
+		c.remoteAddr = t.RemoteAddr()
+	}
+
+	return c
+}
+
+// Write queues a message for the writer goroutine of the connection, applying the
+// connection's policy if the peer has fallen too far behind.
+func (c *Connection) Write(message []byte) error {
+	for {
+		if c.isClosed() {
+			return errors.New("Unable to write, connection is closed.")
+		}
+
+		select {
+		case c.outbound <- message:
+			return nil
+
+		default:
+			// Outbound queue is full - the peer isn't keeping up.
+		}
+
+		switch c.policy {
+		case DropOldest:
+			select {
+			case <-c.outbound:
+				c.logger.Warn("Outbound queue full, dropped oldest message", "socket", fmt.Sprintf("%p", c.socket))
+				c.metrics.droppedMessage()
+			default:
+			}
+
+		case DropNewest:
+			c.metrics.droppedMessage()
+			return errors.New("Outbound queue full, dropped newest message.")
+
+		default:
+			c.metrics.droppedMessage()
+			c.Close()
+			return errors.New("Outbound queue full, disconnecting.")
+		}
+	}
+}
+
+// Close shuts down the writer goroutine, which in turn closes the underlying socket.
+func (c *Connection) Close() error {
+	return c.CloseWith(nil)
+}
+
+// CloseWith shuts down the connection like Close, but writes final to the socket first
+// (skipping anything still waiting in the outbound queue).
+func (c *Connection) CloseWith(final []byte) error {
+	return c.shutdown(final, CloseNormal, "")
+}
+
+// CloseGoingAway shuts down the connection, telling the client that the server is going away.
+func (c *Connection) CloseGoingAway(reason string) error {
+	return c.shutdown(nil, CloseGoingAway, reason)
+}
+
+func (c *Connection) shutdown(final []byte, code int, reason string) error {
+	if c != nil {
+		c.once.Do(func() {
+			c.final = final
+			c.closeCode = code
+			c.closeReason = reason
+			close(c.closed)
+		})
+	}
+
+	return nil
+}
+
+func (c *Connection) isClosed() bool {
+	if c == nil {
+		return true
+	}
+
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Connection) writePump() {
+	defer c.metrics.socketClosed()
+
+	for {
+		select {
+		case <-c.closed:
+			deadline := time.Now().Add(c.timeout)
+			if c.final != nil {
+				if c.socket.WriteMessage(c.final, deadline) == nil {
+					c.metrics.sent(len(c.final))
+				}
+			}
+
+			c.socket.Close(c.closeCode, c.closeReason, deadline)
+			return
+
+		case message := <-c.outbound:
+			// Each write gets a fresh deadline, so an idle connection isn't penalised.
+			err := c.socket.WriteMessage(message, time.Now().Add(c.timeout))
+			if err != nil {
+				c.logger.Error("Can't write to socket, closing", "socket", fmt.Sprintf("%p", c.socket), "err", err)
+				c.metrics.writeFailed()
+				c.Close()
+				c.socket.Close(c.closeCode, c.closeReason, time.Now().Add(c.timeout))
+
+				return
+			}
+			c.metrics.sent(len(message))
+		}
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How often the signalbox is checked for empty rooms while draining.
+const drainPollInterval time.Duration = 250 * time.Millisecond
+
+// How long closed connections have to finish writing their close frames.
+const drainCloseGrace time.Duration = 2 * time.Second
+
+type Reconnect struct {
+	Delay int64  `json:"delay"`         // The number of milliseconds to wait before reconnecting.
+	URL   string `json:"url,omitempty"` // Where to reconnect to, empty reconnects to the same signalbox.
+}
+
+// Drainer keeps track of every open connection, so that they can all be moved off the
+// signalbox before it is shut down (or taken out of service).
+type Drainer struct {
+	lock        sync.Mutex
+	config      Configuration        // How long to wait, and where to send peers.
+	msg         *mailbox             // The signalbox to drain.
+	logger      *Logger              // Where progress draining is logged.
+	draining    bool                 // Are new connections being refused?
+	connections map[*Connection]bool // Every open connection.
+}
+
+func newDrainer(config Configuration, msg *mailbox, logger *Logger) *Drainer {
+	return &Drainer{config: config, msg: msg, logger: logger, connections: make(map[*Connection]bool)}
+}
+
+// configure updates how long to wait, and where to send peers, the next time draining.
+func (d *Drainer) configure(config Configuration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.config = config
+}
+
+func (d *Drainer) configuration() Configuration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.config
+}
+
+// add keeps track of a new connection, returning false if it should be refused instead.
+func (d *Drainer) add(c *Connection) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.draining {
+		return false
+	}
+
+	d.connections[c] = true
+	return true
+}
+
+// remove stops keeping track of a connection once it has closed.
+func (d *Drainer) remove(c *Connection) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.connections, c)
+}
+
+func (d *Drainer) isDraining() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.draining
+}
+
+func (d *Drainer) open() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return len(d.connections)
+}
+
+// start refuses new connections, returning false if the signalbox is already draining.
+func (d *Drainer) start() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.draining {
+		return false
+	}
+
+	d.logger.Info("Draining signalbox")
+	d.draining = true
+	return true
+}
+
+// stop accepts new connections again, abandoning a drain that is still in progress.
+func (d *Drainer) stop() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.logger.Info("Stopped draining signalbox")
+	d.draining = false
+}
+
+// drain moves everyone off a signalbox that has been started draining. Peers are hinted to
+// reconnect (elsewhere) and given until DrainTimeout for their rooms to empty, after which
+// every remaining connection is closed. Cancelling ctx stops waiting for the rooms to empty.
+func (d *Drainer) drain(ctx context.Context) {
+	config := d.configuration()
+	if config.DrainReconnectHint {
+		inSignalBox(d.msg, func(state SignalBox) (SignalBox, adminReply) {
+			return hintReconnect(config, state)
+		})
+	}
+
+	deadline := time.Now().Add(time.Duration(config.DrainTimeout))
+	for time.Now().Before(deadline) && d.isDraining() && ctx.Err() == nil {
+		reply := inSignalBox(d.msg, func(state SignalBox) (SignalBox, adminReply) {
+			return state, adminReply{http.StatusOK, len(state.Rooms)}
+		})
+
+		// A signalbox that has stopped has no rooms left to wait on.
+		if rooms, ok := reply.body.(int); !ok || rooms == 0 {
+			break
+		}
+		time.Sleep(drainPollInterval)
+	}
+
+	if !d.isDraining() {
+		return
+	}
+
+	d.lock.Lock()
+	d.logger.Info("Closing remaining connections", "connections", len(d.connections))
+	for c := range d.connections {
+		c.CloseGoingAway("Signalbox is shutting down")
+	}
+	d.lock.Unlock()
+
+	deadline = time.Now().Add(drainCloseGrace)
+	for time.Now().Before(deadline) && d.open() > 0 {
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// hintReconnect tells every connected peer to reconnect, spreading them over DrainReconnectJitter so
+// that they don't all arrive at once.
+func hintReconnect(config Configuration, state SignalBox) (SignalBox, adminReply) {
+	jitter := int64(time.Duration(config.DrainReconnectJitter) / time.Millisecond)
+
+	for _, p := range state.Peers {
+		if p.socket == nil {
+			continue
+		}
+
+		r := Reconnect{URL: config.DrainReconnectURL}
+		if jitter > 0 {
+			r.Delay = rand.Int63n(jitter)
+		}
+
+		b, _ := json.Marshal(r)
+		writeMessage(p.socket, []string{"/reconnect", string(b)})
+	}
+
+	return state, adminReply{http.StatusOK, nil}
+}
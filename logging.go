@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The levels that messages can be logged at.
+const (
+	DebugLevel int = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// How the contents of messages sent and received by the signalbox are logged.
+const (
+	PayloadsOff      string = "off"      // Don't log the contents of messages at all.
+	PayloadsRedacted string = "redacted" // Log commands and peer ids, but strip SDP and candidate addresses.
+	PayloadsFull     string = "full"     // Log the entire contents of every message.
+)
+
+type Logger struct {
+	lock     sync.Mutex
+	out      io.Writer // Where log lines are written.
+	level    int       // Messages below this level are discarded.
+	json     bool      // Write each line as a JSON object rather than key=value pairs.
+	payloads string    // How the contents of messages are logged.
+}
+
+// defaultLogger is used by anything created outside of a Server, each Server has its own.
+var defaultLogger = newLogger(Configuration{LogLevel: "info", LogFormat: "text", LogPayloads: PayloadsOff}, os.Stderr)
+
+func newLogger(config Configuration, out io.Writer) *Logger {
+	l := &Logger{out: out}
+	l.configure(config)
+
+	return l
+}
+
+// configure updates the level, format and payload logging of the logger from config.
+func (l *Logger) configure(config Configuration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.level = InfoLevel
+	for i, n := range levelNames {
+		if strings.EqualFold(n, config.LogLevel) {
+			l.level = i
+		}
+	}
+
+	l.json = strings.EqualFold(config.LogFormat, "json")
+	l.payloads = config.LogPayloads
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(DebugLevel, msg, keyvals)
+}
+
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(InfoLevel, msg, keyvals)
+}
+
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(WarnLevel, msg, keyvals)
+}
+
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(ErrorLevel, msg, keyvals)
+}
+
+// Payload logs (at debug level) a message sent or received by the signalbox, with the
+// contents of the message included as much as the payload logging mode allows.
+func (l *Logger) Payload(msg string, payload string, keyvals ...interface{}) {
+	l.lock.Lock()
+	mode := l.payloads
+	l.lock.Unlock()
+
+	switch mode {
+	case PayloadsFull:
+		keyvals = append(keyvals, "payload", payload)
+
+	case PayloadsRedacted:
+		keyvals = append(keyvals, "payload", redact(payload))
+
+	default:
+		keyvals = append(keyvals, "bytes", len(payload))
+	}
+
+	l.log(DebugLevel, msg, keyvals)
+}
+
+func (l *Logger) log(level int, msg string, keyvals []interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	var line bytes.Buffer
+
+	if l.json {
+		fields := map[string]interface{}{"time": now, "level": levelNames[level], "msg": msg}
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			fields[fmt.Sprint(keyvals[i])] = logValue(keyvals[i+1])
+		}
+
+		b, _ := json.Marshal(fields)
+		line.Write(b)
+	} else {
+		fmt.Fprintf(&line, "time=%s level=%s msg=%s", now, levelNames[level], quote(msg))
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			fmt.Fprintf(&line, " %s=%s", keyvals[i], quote(fmt.Sprint(logValue(keyvals[i+1]))))
+		}
+	}
+
+	line.WriteString("\n")
+	l.out.Write(line.Bytes())
+}
+
+func logValue(v interface{}) interface{} {
+	if err, ok := v.(error); ok {
+		return err.Error()
+	}
+
+	return v
+}
+
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+// The keys of JSON values that hold session descriptions, network addresses or credentials.
+var sensitiveKeys = map[string]bool{"sdp": true,
+	"candidate":      true,
+	"address":        true,
+	"ip":             true,
+	"relatedAddress": true,
+	"token":          true,
+	"resumeToken":    true}
+
+// redact strips session descriptions, candidate addresses and tokens from a message, leaving the
+// command, peer ids and the shape of any JSON intact.
+func redact(message string) string {
+	var parts []string
+
+	for i := 0; i <= len(message); {
+		rest := message[i:]
+
+		// JSON can hold pipes of its own, so it is decoded in place rather than split apart.
+		if n, v, ok := decodePart(rest); ok {
+			b, _ := json.Marshal(redactValue("", v))
+			parts = append(parts, string(b))
+			i += n + 1
+			continue
+		}
+
+		p := rest
+		if end := strings.Index(rest, "|"); end >= 0 {
+			p = rest[:end]
+		}
+		i += len(p) + 1
+
+		// Anything that isn't JSON, a command or a peer id might be a fragment of broken JSON.
+		if len(parts) > 0 && !strings.HasPrefix(p, "/") && !isPlain(p) {
+			p = "[redacted]"
+		}
+		parts = append(parts, p)
+	}
+
+	return strings.Join(parts, "|")
+}
+
+// decodePart decodes the JSON at the start of s, returning its length if it runs to the end
+// of s or the next pipe.
+func decodePart(s string) (int, interface{}, bool) {
+	var v interface{}
+	d := json.NewDecoder(strings.NewReader(s))
+	if d.Decode(&v) != nil {
+		return 0, nil, false
+	}
+
+	n := int(d.InputOffset())
+	if n < len(s) && s[n] != '|' {
+		return 0, nil, false
+	}
+
+	return n, v, true
+}
+
+func redactValue(key string, v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = redactValue(k, e)
+		}
+
+	case []interface{}:
+		for i, e := range t {
+			t[i] = redactValue(key, e)
+		}
+
+	case string:
+		if sensitiveKeys[key] || isSensitive(t) {
+			return "[redacted]"
+		}
+	}
+
+	return v
+}
+
+// isPlain returns true for short strings that can be logged as they are, like peer ids.
+func isPlain(s string) bool {
+	return len(s) <= 64 && !isSensitive(s) && !strings.ContainsAny(s, "{}[]\"\\:= \t\r\n")
+}
+
+// isSensitive returns true for strings that look like a session description or ICE candidate.
+func isSensitive(s string) bool {
+	return strings.HasPrefix(s, "v=0") || strings.HasPrefix(s, "candidate:") || strings.HasPrefix(s, "a=candidate:")
+}
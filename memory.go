@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// The number of messages that can be waiting for an in-memory peer to receive them.
+const memoryQueueSize int = 64
+
+// memoryTransport is the signalbox end of an in-memory connection.
+type memoryTransport struct {
+	lock        sync.Mutex
+	remoteAddr  string      // Where the peer claims to be connecting from.
+	inbound     chan string // Messages from the peer to the signalbox.
+	outbound    chan string // Messages from the signalbox to the peer, closed with the transport.
+	hungUp      chan bool   // Closed when the peer closes its end.
+	hangupOnce  sync.Once   // Ensures that the peer only hangs up once.
+	closed      chan bool   // Closed when the signalbox closes its end.
+	closeOnce   sync.Once   // Ensures that the signalbox only closes its end once.
+	closeCode   int         // The status code the signalbox closed the connection with.
+	closeReason string      // The reason the signalbox gave for closing the connection.
+	deadline    time.Time   // When ReadMessage gives up, zero waits forever.
+}
+
+// MemoryConn is the peer end of an in-memory connection to a signalbox, for tests and for
+// peers running in the same process.
+type MemoryConn struct {
+	t *memoryTransport
+}
+
+// newMemoryPipe returns both ends of an in-memory connection.
+func newMemoryPipe(remoteAddr string) (*memoryTransport, *MemoryConn) {
+	t := &memoryTransport{remoteAddr: remoteAddr,
+		inbound:  make(chan string),
+		outbound: make(chan string, memoryQueueSize),
+		hungUp:   make(chan bool),
+		closed:   make(chan bool)}
+
+	return t, &MemoryConn{t}
+}
+
+func (t *memoryTransport) ReadMessage() (string, error) {
+	t.lock.Lock()
+	deadline := t.deadline
+	t.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(deadline.Sub(time.Now()))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case m := <-t.inbound:
+		return m, nil
+	case <-t.hungUp:
+		return "", io.EOF
+	case <-t.closed:
+		return "", io.EOF
+	case <-timeout:
+		return "", errors.New("Read timed out")
+	}
+}
+
+func (t *memoryTransport) SetReadDeadline(deadline time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.deadline = deadline
+	return nil
+}
+
+func (t *memoryTransport) WriteMessage(message []byte, deadline time.Time) error {
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+
+	select {
+	case <-t.hungUp:
+		return errors.New("Peer has hung up")
+	case <-t.closed:
+		return errors.New("Connection is closed")
+	default:
+	}
+
+	select {
+	case t.outbound <- string(message):
+		return nil
+	case <-t.hungUp:
+		return errors.New("Peer has hung up")
+	case <-timer.C:
+		return errors.New("Write timed out")
+	}
+}
+
+func (t *memoryTransport) Close(code int, reason string, deadline time.Time) error {
+	t.closeOnce.Do(func() {
+		t.lock.Lock()
+		t.closeCode = code
+		t.closeReason = reason
+		t.lock.Unlock()
+
+		close(t.closed)
+		close(t.outbound)
+	})
+
+	return nil
+}
+
+func (t *memoryTransport) RemoteAddr() string {
+	return t.remoteAddr
+}
+
+// Send delivers message to the signalbox, returning once the signalbox has read it.
+func (m *MemoryConn) Send(message string) error {
+	select {
+	case m.t.inbound <- message:
+		return nil
+	case <-m.t.hungUp:
+		return errors.New("Connection is closed")
+	case <-m.t.closed:
+		return errors.New("Connection is closed")
+	}
+}
+
+// Messages returns the messages sent by the signalbox, which is closed once the signalbox
+// has closed the connection.
+func (m *MemoryConn) Messages() <-chan string {
+	return m.t.outbound
+}
+
+// CloseStatus returns the code and reason the signalbox closed the connection with, once
+// Messages has been closed.
+func (m *MemoryConn) CloseStatus() (int, string) {
+	m.t.lock.Lock()
+	defer m.t.lock.Unlock()
+
+	return m.t.closeCode, m.t.closeReason
+}
+
+// Close hangs up on the signalbox, which sees it like a dropped websocket.
+func (m *MemoryConn) Close() error {
+	m.t.hangupOnce.Do(func() {
+		close(m.t.hungUp)
+	})
+
+	return nil
+}
@@ -17,43 +17,108 @@
  * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
  */
 
-package main
+package signalbox
 
 import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/gorilla/websocket"
-	"log"
+	"reflect"
+	"sort"
 	"strings"
 	"unicode/utf8"
 )
 
-type messageFn func(message []string,
-	sourceSocket *websocket.Conn,
+type messageFn func(message ParsedMessage,
+	sourceSocket *Connection,
 	state SignalBox) (newState SignalBox, err error)
 
-func announce(message []string,
-	sourceSocket *websocket.Conn,
+func announce(message ParsedMessage,
+	sourceSocket *Connection,
 	state SignalBox) (newState SignalBox, err error) {
 
 	source, destination, err := ParsePeerAndRoom(message)
 	if err != nil {
-		return state, err
+		return state, reject(sourceSocket, message, err)
+	}
+
+	if sourceSocket != nil && sourceSocket.id != "" && sourceSocket.id != source.Id {
+		err = protocolError(CodeWrongPeer, "Unable to announce, socket is already bound to %s", sourceSocket.id)
+		return state, reject(sourceSocket, message, err)
 	}
 
 	peer, exists := state.Peers[source.Id]
+	rebind := exists && peer.socket != sourceSocket
+	if rebind {
+		if peer.disconnected {
+			err = protocolError(CodePeerTaken, "Unable to announce, peer %s is waiting to resume", source.Id)
+			return state, reject(sourceSocket, message, err)
+		}
+
+		if !peer.socket.isClosed() {
+			err = protocolError(CodePeerTaken, "Unable to announce, peer %s belongs to another socket", source.Id)
+			return state, reject(sourceSocket, message, err)
+		}
+	}
+
+	// Locked rooms only accept announcements from peers that are already inside.
+	if r, locked := state.Rooms[destination.Room]; locked && r.Locked && state.RoomContains[r.Room][source.Id] == nil {
+		err = protocolError(CodeRoomLocked, "Unable to announce, room %s is locked", destination.Room)
+		return state, reject(sourceSocket, message, err)
+	}
+
+	// Peers already inside the room can always announce into it again.
+	if state.RoomContains[destination.Room][source.Id] == nil {
+		if limit := maxPeersInRoom(state.config, destination.Room); limit > 0 && len(state.RoomContains[destination.Room]) >= limit {
+			err = protocolError(CodeRoomFull, "Unable to announce, room %s is full", destination.Room)
+			return state, reject(sourceSocket, message, err)
+		}
+
+		if limit := state.config.MaxRoomsPerPeer; limit > 0 && len(state.PeerIsIn[source.Id]) >= limit {
+			err = protocolError(CodeTooManyRooms, "Unable to announce, peer %s is already in %d rooms", source.Id, limit)
+			return state, reject(sourceSocket, message, err)
+		}
+	}
+
+	if sourceSocket != nil {
+		sourceSocket.id = source.Id
+	}
+
+	// The socket the peer was using has gone away, let the new one take over.
+	if rebind {
+		state.logger.Info("Rebinding peer", "peer", source.Id)
+		peer.socket = sourceSocket
+	}
+
 	if !exists {
-		log.Printf("INFO - Adding Peer: %s\n", source.Id)
+		state.logger.Info("Adding peer", "peer", source.Id)
 		state.Peers[source.Id] = new(Peer)
 		state.Peers[source.Id].Id = source.Id
 		state.Peers[source.Id].socket = sourceSocket // Inject a reference to the websocket within the new peer.
 		peer = state.Peers[source.Id]
+
+		if state.config.ReconnectWindow > 0 {
+			peer.token, err = newResumeToken()
+			if err != nil {
+				return state, err
+			}
+		}
+	}
+	peer.Announce = message.Payload
+
+	// Peers opt into delivery receipts for their personalised messages when they announce,
+	// and keep their choice across announces that don't mention it.
+	var options struct {
+		Receipts *bool `json:"receipts"`
+	}
+	json.Unmarshal([]byte(message.Payload), &options)
+	if options.Receipts != nil {
+		peer.receipts = *options.Receipts
 	}
 
 	room, exists := state.Rooms[destination.Room]
 	if !exists {
-		log.Printf("INFO - Adding Room: %s\n", destination.Room)
+		state.logger.Info("Adding room", "room", destination.Room)
 		state.Rooms[destination.Room] = new(Room)
 		state.Rooms[destination.Room].Room = destination.Room
 		room = state.Rooms[destination.Room]
@@ -72,87 +137,195 @@ func announce(message []string,
 	// Annouce the arrival to all the peers currently in the room.
 	for _, p := range state.RoomContains[room.Room] {
 		if p.Id != peer.Id && p.socket != nil {
-			writeMessage(p.socket, message)
+			writeMessage(p.socket, message.Parts())
 		}
 	}
 
-	// Report back to the announcer the number of peers in the room.
-	members := fmt.Sprintf("{\"memberCount\":%d}", len(state.RoomContains[room.Room]))
-	err = writeMessage(sourceSocket, []string{"/roominfo", members})
+	// Report back to the announcer the number of peers in the room, along with who they are.
+	ri := roomInfo(peer, room, state)
+	ri.ResumeToken = peer.token
+	info, err := json.Marshal(ri)
+	if err != nil {
+		return state, err
+	}
+	err = writeMessage(sourceSocket, []string{"/roominfo", string(info)})
 
 	return state, nil
 }
 
-func leave(message []string,
-	sourceSocket *websocket.Conn,
+type RoomInfo struct {
+	MemberCount int          `json:"memberCount"`           // The number of peers in the room, including the announcer.
+	Members     []RoomMember `json:"members"`               // Everyone else in the room.
+	ResumeToken string       `json:"resumeToken,omitempty"` // The token the announcer can use to resume after a dropped connection.
+}
+
+type RoomMember struct {
+	Id   string          `json:"id"`   // The unique identifier of the member.
+	Data json.RawMessage `json:"data"` // The JSON the member announced itself with.
+}
+
+// roomInfo builds the /roominfo reply sent to source when it announces into destination,
+// replaying the announce of every other member so source knows who is already there.
+func roomInfo(source *Peer, destination *Room, state SignalBox) RoomInfo {
+	info := RoomInfo{MemberCount: len(state.RoomContains[destination.Room]), Members: []RoomMember{}}
+
+	for _, p := range state.RoomContains[destination.Room] {
+		if p.Id != source.Id {
+			info.Members = append(info.Members, RoomMember{p.Id, json.RawMessage(p.Announce)})
+		}
+	}
+	sort.Sort(byId(info.Members))
+
+	return info
+}
+
+type byId []RoomMember
+
+func (m byId) Len() int           { return len(m) }
+func (m byId) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byId) Less(i, j int) bool { return m[i].Id < m[j].Id }
+
+func leave(message ParsedMessage,
+	sourceSocket *Connection,
 	state SignalBox) (newState SignalBox, err error) {
 
 	source, destination, err := ParsePeerAndRoom(message)
 	if err != nil {
-		return state, err
+		return state, reject(sourceSocket, message, err)
+	}
+
+	err = checkSender(source.Id, sourceSocket)
+	if err != nil {
+		return state, reject(sourceSocket, message, err)
 	}
 
 	peer, exists := state.Peers[source.Id]
 	if !exists {
-		return state, errors.New(fmt.Sprintf("Unable to leave, peer %s doesn't exist", source.Id))
+		err = protocolError(CodeUnknownPeer, "Unable to leave, peer %s doesn't exist", source.Id)
+		return state, reject(sourceSocket, message, err)
 	}
 
 	room, exists := state.Rooms[destination.Room]
 	if !exists {
-		return state, errors.New(fmt.Sprintf("Unable to leave, room %s doesn't exist", destination.Room))
+		err = protocolError(CodeNotInRoom, "Unable to leave, room %s doesn't exist", destination.Room)
+		return state, reject(sourceSocket, message, err)
 	}
 
 	return removePeer(peer, room, message, state)
 }
 
-func closePeer(message []string,
-	sourceSocket *websocket.Conn,
+func closePeer(message ParsedMessage,
+	sourceSocket *Connection,
 	state SignalBox) (newState SignalBox, err error) {
 
 	source := findPeerBySocket(sourceSocket, state)
 	if source == nil {
-		return state, errors.New("Unable to close - no Peer matching socket.")
+		err = reject(sourceSocket, message, protocolError(CodeNotAnnounced, "Unable to close - no Peer matching socket."))
+		sourceSocket.Close()
+		return state, err
 	}
 
-	// Announce to everyone that the peer belonging to sourceSocket
-	// has closed and bailed out of their rooms.
+	if state.config.ReconnectWindow > 0 && source.token != "" {
+		// Hold onto the peer for a little while, it might just be a network blip.
+		state = holdPeer(source, state)
+	} else {
+		state, err = leaveAllRooms(source, state)
+	}
+
+	// Make sure the socket is closed from this end.
+	sourceSocket.Close()
+
+	return state, err
+}
+
+// leaveAllRooms removes source from every room it is in, announcing to everyone that
+// source has closed and bailed out of their rooms.
+func leaveAllRooms(source *Peer, state SignalBox) (newState SignalBox, err error) {
 	for _, r := range state.PeerIsIn[source.Id] {
-		for _, p := range state.RoomContains[r.Room] {
-			if p.Id != source.Id && p.socket != nil {
-				rm := fmt.Sprintf("{\"room\":\"%s\"}", r.Room)
+		rm := fmt.Sprintf("{\"room\":\"%s\"}", r.Room)
 
-				state, err = removePeer(source, r, []string{"/leave", source.Id, rm}, state)
-				if err != nil {
-					return state, err
-				}
-			}
+		var e error
+		state, e = removePeer(source, r, ParsedMessage{Command: "/leave", Peer: source.Id, Payload: rm}, state)
+		if e != nil && err == nil {
+			err = e
 		}
 	}
 
-	// Make sure the socket is closed from this end.
-	err = sourceSocket.Close()
+	return state, err
+}
+
+func lock(message ParsedMessage,
+	sourceSocket *Connection,
+	state SignalBox) (newState SignalBox, err error) {
+
+	return setLocked(true, message, sourceSocket, state)
+}
+
+func unlock(message ParsedMessage,
+	sourceSocket *Connection,
+	state SignalBox) (newState SignalBox, err error) {
+
+	return setLocked(false, message, sourceSocket, state)
+}
+
+func setLocked(locked bool, message ParsedMessage, sourceSocket *Connection, state SignalBox) (newState SignalBox, err error) {
+	source, destination, err := ParsePeerAndRoom(message)
+	if err != nil {
+		return state, reject(sourceSocket, message, err)
+	}
+
+	err = checkSender(source.Id, sourceSocket)
+	if err != nil {
+		return state, reject(sourceSocket, message, err)
+	}
+
+	// Only peers inside a room can change whether it is locked.
+	room, exists := state.Rooms[destination.Room]
+	if !exists || state.RoomContains[room.Room][source.Id] == nil {
+		err = protocolError(CodeNotInRoom, "Unable to %s, peer %s isn't in room %s", message.Command[1:], source.Id, destination.Room)
+		return state, reject(sourceSocket, message, err)
+	}
+
+	if room.Locked == locked {
+		return state, nil
+	}
+
+	state.logger.Info("Setting room lock", "room", room.Room, "locked", locked)
+	room.Locked = locked
+
+	// Let everyone in the room know (including the peer that made the change).
+	for _, p := range state.RoomContains[room.Room] {
+		if p.socket != nil {
+			if e := writeMessage(p.socket, message.Parts()); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
 
 	return state, err
 }
 
-func removePeer(source *Peer, destination *Room, message []string, state SignalBox) (newState SignalBox, err error) {
+func removePeer(source *Peer, destination *Room, message ParsedMessage, state SignalBox) (newState SignalBox, err error) {
 	delete(state.PeerIsIn[source.Id], destination.Room)
 	if len(state.PeerIsIn[source.Id]) == 0 {
-		log.Printf("INFO - Removing Peer: %s\n", source.Id)
+		state.logger.Info("Removing peer", "peer", source.Id)
 		delete(state.Peers, source.Id)
 		delete(state.PeerIsIn, source.Id)
 	}
 
 	delete(state.RoomContains[destination.Room], source.Id)
 	if len(state.RoomContains[destination.Room]) == 0 {
-		log.Printf("INFO - Removing Room: %s\n", destination.Room)
+		state.logger.Info("Removing room", "room", destination.Room)
 		delete(state.Rooms, destination.Room)
 		delete(state.RoomContains, destination.Room)
 	} else {
-		// Broadcast the departure to everyone else still in the room
+		// Broadcast the departure to everyone else still in the room, a peer
+		// that has fallen behind doesn't stop the others from hearing about it.
 		for _, p := range state.RoomContains[destination.Room] {
-			if p.socket != nil && err == nil {
-				err = writeMessage(p.socket, message)
+			if p.socket != nil {
+				if e := writeMessage(p.socket, message.Parts()); e != nil && err == nil {
+					err = e
+				}
 			}
 		}
 	}
@@ -160,55 +333,274 @@ func removePeer(source *Peer, destination *Room, message []string, state SignalB
 	return state, err
 }
 
-func to(message []string,
-	sourceSocket *websocket.Conn,
+func to(message ParsedMessage,
+	sourceSocket *Connection,
 	state SignalBox) (newState SignalBox, err error) {
 
-	if len(message) < 3 {
-		return state, errors.New("Not enouth parts for personalised 'to' message")
+	if message.Payload == "" {
+		return state, reject(sourceSocket, message, errors.New("Not enouth parts for personalised 'to' message"))
 	}
 
-	d, exists := state.Peers[message[1]]
-	if !exists {
-		return state, nil
+	// Only peers that have announced themselves can send personalised messages.
+	if sourceSocket != nil && sourceSocket.id == "" {
+		return state, reject(sourceSocket, message, protocolError(CodeNotAnnounced, "Unable to send 'to' message, socket hasn't announced"))
 	}
 
-	if d.socket != nil {
-		err = writeMessage(d.socket, message)
+	// Messages without a socket are raised by the signalbox itself, everything else has to
+	// come from a peer that is still in a room (the socket stays bound after a peer leaves).
+	var sender *Peer
+	if sourceSocket != nil {
+		sender = state.Peers[sourceSocket.id]
+		if sender == nil {
+			return state, reject(sourceSocket, message, protocolError(CodeNotAnnounced, "Unable to send 'to' message, peer %s isn't in any rooms", sourceSocket.id))
+		}
+	}
+
+	// The metadata after the relayed command names the sender, which recipients trust.
+	if id, named := toSender(message.Payload); named {
+		err = checkSender(id, sourceSocket)
+		if err != nil {
+			return state, reject(sourceSocket, message, err)
+		}
+	}
+
+	recipients, err := toRecipients(message.Peer, sender, state)
+	if err != nil {
+		return state, reject(sourceSocket, message, err)
+	}
+
+	// Every recipient gets the message addressed to just them.
+	for _, id := range recipients {
+		m := message
+		m.Peer = id
+
+		if e := deliver(sender, sourceSocket, m, state); e != nil && err == nil {
+			err = e
+		}
 	}
 
 	return state, err
 }
 
-func writeMessage(ws *websocket.Conn, message []string) error {
+// toSender returns the id named by the metadata of a /to payload (like /offer|{"id":"a"}|..),
+// and false when the payload doesn't name one.
+func toSender(payload string) (string, bool) {
+	parts := strings.SplitN(payload, "|", 3)
+	if len(parts) < 2 {
+		return "", false
+	}
+
+	var metadata struct {
+		Id *string `json:"id"`
+	}
+	if json.Unmarshal([]byte(parts[1]), &metadata) != nil || metadata.Id == nil {
+		return "", false
+	}
+
+	return *metadata.Id, true
+}
+
+// toRecipients returns the ids of the peers a /to is addressed to. The target is either a
+// single peer id, a JSON list of ids (like ["b","c"]), or a JSON selector matching the announce
+// of the peers in a room (like {"room":"x","role":"presenter"}).
+func toRecipients(target string, sender *Peer, state SignalBox) ([]string, error) {
+	switch {
+	case strings.HasPrefix(target, "["):
+		var ids []string
+		err := json.Unmarshal([]byte(target), &ids)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients := []string{}
+		seen := map[string]bool{}
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				recipients = append(recipients, id)
+			}
+		}
+
+		return recipients, nil
+
+	case strings.HasPrefix(target, "{"):
+		var selector map[string]interface{}
+		err := json.Unmarshal([]byte(target), &selector)
+		if err != nil {
+			return nil, err
+		}
+
+		return selectRecipients(selector, sender, state)
+
+	default:
+		return []string{target}, nil
+	}
+}
+
+// selectRecipients returns the ids of the peers (other than sender) whose announce matches
+// every field of selector. The "room" field narrows the selection to a single room the sender
+// is in, otherwise every room the sender is in is searched.
+func selectRecipients(selector map[string]interface{}, sender *Peer, state SignalBox) ([]string, error) {
+	// Selectors only ever reach into the rooms of the peer using them.
+	if sender == nil {
+		return nil, protocolError(CodeNotAnnounced, "Unable to send 'to' message, selectors need a sender")
+	}
+
+	rooms := state.PeerIsIn[sender.Id]
+	if room, ok := selector["room"].(string); ok {
+		r, inside := rooms[room]
+		if !inside {
+			return nil, protocolError(CodeNotInRoom, "Unable to send 'to' message, peer %s isn't in room %s", sender.Id, room)
+		}
+
+		rooms = map[string]*Room{room: r}
+		delete(selector, "room")
+	}
+
+	recipients := []string{}
+	seen := map[string]bool{}
+	for _, r := range rooms {
+		for _, p := range state.RoomContains[r.Room] {
+			if seen[p.Id] || p == sender {
+				continue
+			}
+			seen[p.Id] = true
+
+			var announce map[string]interface{}
+			json.Unmarshal([]byte(p.Announce), &announce)
+			if matches(selector, announce) {
+				recipients = append(recipients, p.Id)
+			}
+		}
+	}
+	sort.Strings(recipients)
+
+	return recipients, nil
+}
+
+// matches returns true if every field of selector has the same value in announce.
+func matches(selector map[string]interface{}, announce map[string]interface{}) bool {
+	for k, v := range selector {
+		if !reflect.DeepEqual(announce[k], v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// deliver sends a personalised message to the single peer it is addressed to.
+func deliver(sender *Peer, sourceSocket *Connection, message ParsedMessage, state SignalBox) error {
+	// Peers can only send personalised messages to the peers they share a room with.
+	d, exists := state.Peers[message.Peer]
+	if !exists || (sender != nil && !shareRoom(sender, d, state)) {
+		err := protocolError(CodeUnknownPeer, "Unable to send 'to' message, peer %s isn't in any of your rooms", message.Peer)
+		return undelivered(sender, sourceSocket, message, ReceiptUnknownPeer, err)
+	}
+
+	if d.disconnected {
+		// Keep hold of the message until the peer resumes (or doesn't).
+		d.pending = append(d.pending, message.Parts())
+		if len(d.pending) > state.config.OutboundQueueSize {
+			d.pending = d.pending[1:]
+		}
+
+		return delivered(sender, sourceSocket, message, ReceiptQueued)
+	}
+
+	if d.socket != nil {
+		err := writeMessage(d.socket, message.Parts())
+		if err != nil {
+			err = protocolError(CodeNotDelivered, "Unable to deliver 'to' message to %s, %s", d.Id, err)
+			return undelivered(sender, sourceSocket, message, ReceiptFailed, err)
+		}
+	}
+
+	return delivered(sender, sourceSocket, message, ReceiptDelivered)
+}
+
+// shareRoom returns true if source and destination are both inside at least one room.
+func shareRoom(source *Peer, destination *Peer, state SignalBox) bool {
+	for r := range state.PeerIsIn[source.Id] {
+		if state.RoomContains[r][destination.Id] != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// delivered sends sender a receipt with status for its personalised message, if it asked for them.
+func delivered(sender *Peer, sourceSocket *Connection, message ParsedMessage, status string) error {
+	if sender == nil || !sender.receipts {
+		return nil
+	}
+
+	return writeMessage(sourceSocket, receiptMessage(message, status))
+}
+
+// undelivered reports a personalised message that didn't reach its recipient, with a receipt
+// if the sender asked for them, otherwise with an /error.
+func undelivered(sender *Peer, sourceSocket *Connection, message ParsedMessage, status string, err error) error {
+	if sender == nil || !sender.receipts {
+		return reject(sourceSocket, message, err)
+	}
+
+	writeMessage(sourceSocket, receiptMessage(message, status))
+	return err
+}
+
+func writeMessage(c *Connection, message []string) error {
 	b := strings.Join(message, "|")
-	if ws != nil {
-		log.Printf("INFO - Writing %s to %p", b, ws)
-		return ws.WriteMessage(websocket.TextMessage, []byte(b))
+	if c != nil {
+		c.logger.Payload("Writing message", b, "socket", fmt.Sprintf("%p", c.socket))
+		return c.Write([]byte(b))
 	}
 
 	return nil
 }
 
-func custom(message []string,
-	sourceSocket *websocket.Conn,
+func custom(message ParsedMessage,
+	sourceSocket *Connection,
 	state SignalBox) (newState SignalBox, err error) {
 
-	if len(message) < 2 {
-		return state, errors.New("Not enough parts to custom message")
+	if message.Peer == "" {
+		return state, reject(sourceSocket, message, errors.New("Not enough parts to custom message"))
 	}
 
-	source := Peer{message[1], nil}
+	source := Peer{Id: message.Peer}
+
+	err = checkSender(source.Id, sourceSocket)
+	if err != nil {
+		return state, reject(sourceSocket, message, err)
+	}
 
 	peer, exists := state.Peers[source.Id]
 	if !exists {
 		return state, nil
 	}
 
-	for _, r := range state.PeerIsIn[peer.Id] {
+	// Messages naming a room only go to that room, otherwise they go to every room the
+	// sender is in.
+	rooms := state.PeerIsIn[peer.Id]
+	if room := customRoom(message.Payload); room != "" {
+		r, inside := rooms[room]
+		if !inside {
+			err = protocolError(CodeNotInRoom, "Unable to send %s, peer %s isn't in room %s", message.Command, peer.Id, room)
+			return state, reject(sourceSocket, message, err)
+		}
+		rooms = map[string]*Room{room: r}
+	}
+
+	// Peers sharing more than one room with the sender still only get the message once.
+	sent := map[string]bool{peer.Id: true}
+	for _, r := range rooms {
 		for _, p := range state.RoomContains[r.Room] {
-			if p.Id != peer.Id && p.socket != nil && err == nil {
-				err = writeMessage(p.socket, message)
+			if !sent[p.Id] && p.socket != nil {
+				sent[p.Id] = true
+				if e := writeMessage(p.socket, message.Parts()); e != nil && err == nil {
+					err = e
+				}
 			}
 		}
 	}
@@ -216,13 +608,41 @@ func custom(message []string,
 	return state, err
 }
 
-func ignore(message []string,
-	sourceSocket *websocket.Conn,
+// customRoom returns the room a custom message is addressed to, when its payload starts
+// with JSON naming one (like /hello|a|{"room":"lobby"}).
+func customRoom(payload string) string {
+	var target struct {
+		Room string `json:"room"`
+	}
+
+	if json.NewDecoder(strings.NewReader(payload)).Decode(&target) != nil {
+		return ""
+	}
+
+	return target.Room
+}
+
+func ignore(message ParsedMessage,
+	sourceSocket *Connection,
 	state SignalBox) (newState SignalBox, err error) {
 	return state, nil
 }
 
-func findPeerBySocket(sourceSocket *websocket.Conn, state SignalBox) *Peer {
+// checkSender makes sure that a message claiming to be from the peer id, was sent
+// across the socket that id was bound to when the peer first announced itself.
+func checkSender(id string, sourceSocket *Connection) error {
+	if sourceSocket == nil || sourceSocket.id == id {
+		return nil
+	}
+
+	if sourceSocket.id == "" {
+		return protocolError(CodeNotAnnounced, "Message claims to be from %s, but socket hasn't announced", id)
+	}
+
+	return protocolError(CodeWrongPeer, "Message claims to be from %s, but socket is bound to %s", id, sourceSocket.id)
+}
+
+func findPeerBySocket(sourceSocket *Connection, state SignalBox) *Peer {
 	for _, p := range state.Peers {
 		if p.socket == sourceSocket {
 			return p
@@ -232,30 +652,76 @@ func findPeerBySocket(sourceSocket *websocket.Conn, state SignalBox) *Peer {
 	return nil
 }
 
-func ParsePeerAndRoom(message []string) (source Peer, destination Room, err error) {
-	if len(message) < 3 {
+// ParsedMessage is a message from a peer, split on its framing. Only the command and the peer
+// it names are split off, everything after them is one opaque payload, so that a "|" inside
+// announce JSON or an SDP doesn't break the message apart.
+type ParsedMessage struct {
+	Command   string // The command, like "/announce".
+	Peer      string // The peer the message names, the sender (or the recipient of a /to).
+	Payload   string // Everything after the peer, like the announce JSON or the message a /to relays.
+	RequestId string // The optional id the sender prefixed the message with (#<id>|), echoed in the /ack or /error.
+}
+
+// Parts returns the framed parts of the message, leaving off any that are missing. The request
+// id is only meaningful to the sender, so it isn't included when the message is relayed.
+func (m ParsedMessage) Parts() []string {
+	parts := []string{m.Command, m.Peer, m.Payload}
+	for len(parts) > 1 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+
+	return parts
+}
+
+// String returns the message as it is framed on the wire.
+func (m ParsedMessage) String() string {
+	if m.RequestId != "" {
+		return "#" + m.RequestId + "|" + strings.Join(m.Parts(), "|")
+	}
+
+	return strings.Join(m.Parts(), "|")
+}
+
+// splitFrame splits message into its request id, command, the peer it names and its payload.
+func splitFrame(message string) ParsedMessage {
+	requestId, message := splitRequestId(message)
+	parts := strings.SplitN(message, "|", 3)
+
+	m := ParsedMessage{Command: parts[0], RequestId: requestId}
+	if len(parts) > 1 {
+		m.Peer = parts[1]
+	}
+	if len(parts) > 2 {
+		m.Payload = parts[2]
+	}
+
+	return m
+}
+
+func ParsePeerAndRoom(message ParsedMessage) (source Peer, destination Room, err error) {
+	if message.Payload == "" {
 		return Peer{}, Room{}, errors.New("Not enough parts in the message body to parse peer and room.")
 	}
 
-	err = json.Unmarshal([]byte(message[2]), &destination)
+	err = json.Unmarshal([]byte(message.Payload), &destination)
 	if err != nil {
 		return Peer{}, Room{}, err
 	}
 
-	return Peer{message[1], nil}, destination, nil
+	return Peer{Id: message.Peer}, destination, nil
 }
 
-func ParseMessage(message string) (action messageFn, messageBody []string, err error) {
+func ParseMessage(message string) (action messageFn, messageBody ParsedMessage, err error) {
 	// All messages are text (utf-8 encoded at present)
 	if !utf8.Valid([]byte(message)) {
-		return nil, nil, errors.New("Message is not utf-8 encoded")
+		return nil, ParsedMessage{}, errors.New("Message is not utf-8 encoded")
 	}
 
-	parts := strings.Split(message, "|")
+	parts := splitFrame(message)
 
 	// rtc.io commands start with "/" - ignore everything else.
-	if len(message) > 0 && message[0:1] == "/" {
-		switch parts[0] {
+	if strings.HasPrefix(parts.Command, "/") {
+		switch parts.Command {
 		case "/announce":
 			return announce, parts, nil
 
@@ -268,6 +734,15 @@ func ParseMessage(message string) (action messageFn, messageBody []string, err e
 		case "/close":
 			return closePeer, parts, nil
 
+		case "/resume":
+			return resume, parts, nil
+
+		case "/lock":
+			return lock, parts, nil
+
+		case "/unlock":
+			return unlock, parts, nil
+
 		default:
 			return custom, parts, nil
 		}
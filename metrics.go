@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The upper bounds (in seconds) of the buckets used for the message handling histogram.
+var durationBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1}
+
+// Metrics collects the counters and gauges exposed in the Prometheus text format on /metrics.
+type Metrics struct {
+	lock          sync.Mutex
+	sockets       int64             // The number of websockets currently connected.
+	peers         int               // The number of peers currently inside the signalbox.
+	rooms         int               // The number of rooms currently inside the signalbox.
+	commands      map[string]uint64 // The number of messages dispatched, by command.
+	bytesIn       uint64            // The number of bytes read from websockets.
+	bytesOut      uint64            // The number of bytes written to websockets.
+	writeFailures uint64            // The number of writes to websockets that failed.
+	dropped       uint64            // The number of messages dropped because a peer fell behind.
+	limited       uint64            // The number of sockets disconnected for exceeding a rate limit.
+	counts        []uint64          // The number of handled messages that fell into each duration bucket.
+	sum           float64           // The total number of seconds spent handling messages.
+	count         uint64            // The total number of handled messages.
+}
+
+// defaultMetrics collects for anything created outside of a Server, each Server has its own.
+var defaultMetrics = newMetrics()
+
+func newMetrics() *Metrics {
+	return &Metrics{commands: make(map[string]uint64), counts: make([]uint64, len(durationBuckets))}
+}
+
+// commandName is the label used when counting a message dispatched by ParseMessage.
+func commandName(message ParsedMessage) string {
+	switch message.Command {
+	case "/announce", "/leave", "/to", "/close", "/lock", "/unlock", "/resume":
+		return message.Command[1:]
+	}
+
+	if strings.HasPrefix(message.Command, "/") {
+		return "custom"
+	}
+
+	return "ignored"
+}
+
+func (m *Metrics) socketOpened() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sockets++
+}
+
+func (m *Metrics) socketClosed() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sockets--
+}
+
+func (m *Metrics) received(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bytesIn += uint64(n)
+}
+
+func (m *Metrics) sent(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bytesOut += uint64(n)
+}
+
+func (m *Metrics) writeFailed() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.writeFailures++
+}
+
+func (m *Metrics) droppedMessage() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dropped++
+}
+
+func (m *Metrics) rateLimited() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.limited++
+}
+
+// handled records that the signalbox took d to handle a command, leaving it with the
+// supplied state.
+func (m *Metrics) handled(command string, d time.Duration, state SignalBox) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.commands[command]++
+	m.peers = len(state.Peers)
+	m.rooms = len(state.Rooms)
+
+	seconds := d.Seconds()
+	for i, b := range durationBuckets {
+		if seconds <= b {
+			m.counts[i]++
+		}
+	}
+	m.sum += seconds
+	m.count++
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metric(w, "signalbox_sockets", "gauge", "The number of websockets currently connected.")
+	fmt.Fprintf(w, "signalbox_sockets %d\n", m.sockets)
+
+	metric(w, "signalbox_peers", "gauge", "The number of peers currently inside the signalbox.")
+	fmt.Fprintf(w, "signalbox_peers %d\n", m.peers)
+
+	metric(w, "signalbox_rooms", "gauge", "The number of rooms currently inside the signalbox.")
+	fmt.Fprintf(w, "signalbox_rooms %d\n", m.rooms)
+
+	metric(w, "signalbox_messages_total", "counter", "The number of messages dispatched, by command.")
+	commands := []string{}
+	for c := range m.commands {
+		commands = append(commands, c)
+	}
+	sort.Strings(commands)
+	for _, c := range commands {
+		fmt.Fprintf(w, "signalbox_messages_total{command=%q} %d\n", c, m.commands[c])
+	}
+
+	metric(w, "signalbox_received_bytes_total", "counter", "The number of bytes read from websockets.")
+	fmt.Fprintf(w, "signalbox_received_bytes_total %d\n", m.bytesIn)
+
+	metric(w, "signalbox_sent_bytes_total", "counter", "The number of bytes written to websockets.")
+	fmt.Fprintf(w, "signalbox_sent_bytes_total %d\n", m.bytesOut)
+
+	metric(w, "signalbox_write_failures_total", "counter", "The number of writes to websockets that failed.")
+	fmt.Fprintf(w, "signalbox_write_failures_total %d\n", m.writeFailures)
+
+	metric(w, "signalbox_dropped_messages_total", "counter", "The number of messages dropped because a peer fell behind.")
+	fmt.Fprintf(w, "signalbox_dropped_messages_total %d\n", m.dropped)
+
+	metric(w, "signalbox_rate_limited_total", "counter", "The number of sockets disconnected for exceeding a rate limit.")
+	fmt.Fprintf(w, "signalbox_rate_limited_total %d\n", m.limited)
+
+	metric(w, "signalbox_message_duration_seconds", "histogram", "The time spent handling each message in the signalbox.")
+	for i, b := range durationBuckets {
+		le := strconv.FormatFloat(b, 'g', -1, 64)
+		fmt.Fprintf(w, "signalbox_message_duration_seconds_bucket{le=%q} %d\n", le, m.counts[i])
+	}
+	fmt.Fprintf(w, "signalbox_message_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(w, "signalbox_message_duration_seconds_sum %s\n", strconv.FormatFloat(m.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "signalbox_message_duration_seconds_count %d\n", m.count)
+}
+
+func metric(w http.ResponseWriter, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The configuration file read when none is given.
+const defaultConfigFile string = "signalbox.json"
+
+// The prefix of environment variables that override settings in the configuration file.
+const envPrefix string = "SIGNALBOX_"
+
+// Options are what signalbox was started with, on top of the configuration file.
+type Options struct {
+	ConfigFile  string            // The configuration file to read.
+	Explicit    bool              // Was the configuration file named, rather than the default?
+	PrintConfig bool              // Print the effective configuration and exit?
+	Overrides   map[string]string // Settings given on the command line, by field name.
+}
+
+// settingName converts a field name to the words used for its flag and environment variable
+// ("AuthJWTSecretFile" becomes auth, jwt, secret and file).
+func settingName(field string) []string {
+	var words []string
+	r := []rune(field)
+	start := 0
+
+	for i := 1; i < len(r); i++ {
+		lowerToUpper := unicode.IsLower(r[i-1]) && unicode.IsUpper(r[i])
+		endOfAcronym := unicode.IsUpper(r[i-1]) && unicode.IsUpper(r[i]) && i+1 < len(r) && unicode.IsLower(r[i+1])
+		if lowerToUpper || endOfAcronym {
+			words = append(words, strings.ToLower(string(r[start:i])))
+			start = i
+		}
+	}
+
+	return append(words, strings.ToLower(string(r[start:])))
+}
+
+func flagName(field string) string {
+	return strings.Join(settingName(field), "-")
+}
+
+func envName(field string) string {
+	return envPrefix + strings.ToUpper(strings.Join(settingName(field), "_"))
+}
+
+// override records a setting given on the command line, to be applied over the file.
+type override struct {
+	field     string
+	boolean   bool // Can the flag be given without a value (--reload-on-change)?
+	overrides map[string]string
+}
+
+func (o override) String() string {
+	return ""
+}
+
+func (o override) Set(value string) error {
+	o.overrides[o.field] = value
+	return nil
+}
+
+func (o override) IsBoolFlag() bool {
+	return o.boolean
+}
+
+// ParseOptions parses the command line. Every setting has a flag (SocketTimeout is
+// --socket-timeout), and the configuration file can be given with --config or as the only
+// argument.
+func ParseOptions(args []string) (Options, error) {
+	options := Options{ConfigFile: defaultConfigFile, Overrides: make(map[string]string)}
+
+	flags := flag.NewFlagSet("signalbox", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&options.ConfigFile, "config", defaultConfigFile, "The configuration file to read.")
+	flags.BoolVar(&options.PrintConfig, "print-config", false, "Print the effective configuration and exit.")
+
+	t := reflect.TypeOf(Configuration{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		flags.Var(override{f.Name, f.Type.Kind() == reflect.Bool, options.Overrides}, flagName(f.Name), "Overrides "+f.Name+".")
+	}
+
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		flags.SetOutput(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Usage: signalbox [flags] [configuration file]")
+		flags.PrintDefaults()
+	}
+	if err != nil {
+		return options, err
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			options.Explicit = true
+		}
+	})
+
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		options.ConfigFile = flags.Arg(0)
+		options.Explicit = true
+	default:
+		return options, errors.New(fmt.Sprintf("Unexpected arguments %v", flags.Args()[1:]))
+	}
+
+	return options, nil
+}
+
+// LoadConfiguration builds the configuration from the defaults, the configuration file,
+// SIGNALBOX_* environment variables and then the command line, each overriding the last.
+// The default configuration file may be missing, but everything else must be valid.
+func LoadConfiguration(options Options, environ []string) (Configuration, error) {
+	config, err := parseConfiguration(options.ConfigFile)
+	if err != nil && (options.Explicit || !os.IsNotExist(err)) {
+		return config, err
+	}
+
+	fields := make(map[string]string)
+	t := reflect.TypeOf(config)
+	for i := 0; i < t.NumField(); i++ {
+		fields[envName(t.Field(i).Name)] = t.Field(i).Name
+	}
+
+	for _, e := range environ {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], envPrefix) {
+			continue
+		}
+
+		field, exists := fields[kv[0]]
+		if !exists {
+			return config, errors.New(fmt.Sprintf("Unknown setting %s", kv[0]))
+		}
+
+		err = setField(&config, field, kv[1])
+		if err != nil {
+			return config, errors.New(fmt.Sprintf("%s: %s", kv[0], err))
+		}
+	}
+
+	for field, value := range options.Overrides {
+		err = setField(&config, field, value)
+		if err != nil {
+			return config, errors.New(fmt.Sprintf("--%s: %s", flagName(field), err))
+		}
+	}
+
+	return config, config.validate()
+}
+
+// setField sets the named field of config from a flag or environment variable. Lists are
+// separated by commas, and anything more complicated is written as JSON.
+func setField(config *Configuration, field string, value string) error {
+	f := reflect.ValueOf(config).Elem().FieldByName(field)
+
+	switch p := f.Addr().Interface().(type) {
+	case *Duration:
+		return p.parse(value)
+
+	case *string:
+		*p = value
+
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*p = b
+
+	case *int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*p = i
+
+	case *[]string:
+		*p = nil
+		if strings.HasPrefix(value, "[") {
+			return json.Unmarshal([]byte(value), p)
+		}
+
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*p = append(*p, s)
+			}
+		}
+
+	default:
+		f.Set(reflect.Zero(f.Type()))
+		return decodeStrict([]byte(value), p)
+	}
+
+	return nil
+}
+
+// FormatConfiguration writes config as JSON, leaving out the admin token.
+func FormatConfiguration(config Configuration) string {
+	if config.AdminToken != "" {
+		config.AdminToken = "[redacted]"
+	}
+
+	b, _ := json.MarshalIndent(config, "", "\t")
+	return string(b) + "\n"
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"net/url"
+	"strings"
+)
+
+// originAllowed returns true if a websocket upgrade from origin should be accepted. Each
+// allowed origin is either exact ("https://example.com"), or matches any subdomain
+// ("https://*.example.com"). Leaving out the scheme ("*.example.com") matches any scheme.
+//
+// Requests without an origin don't come from a browser, and an empty allowed list accepts
+// every origin.
+func originAllowed(allowed []string, origin string) bool {
+	if len(allowed) == 0 || origin == "" {
+		return true
+	}
+
+	o, err := url.Parse(origin)
+	if err != nil || o.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(o.Scheme)
+	host := strings.ToLower(o.Host)
+
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+
+		pattern := a
+		if i := strings.Index(a, "://"); i != -1 {
+			if a[:i] != scheme {
+				continue
+			}
+			pattern = a[i+3:]
+		}
+
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if pattern == host {
+			return true
+		}
+	}
+
+	return false
+}
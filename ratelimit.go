@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// How long an address has to go without exceeding a limit before its offences are forgotten.
+const offenceMemory time.Duration = time.Hour
+
+// The number of tracked addresses that triggers a sweep for idle ones.
+const rateLimiterSweepSize int = 4096
+
+// The number of recent offences an address is only disconnected for, before it is banned.
+const offencesBeforeBan int = 1
+
+// The most times a ban is doubled for repeat offences.
+const maxBanDoublings uint = 16
+
+type RateLimit struct {
+	Messages float64 // The number of messages allowed each second, zero is unlimited.
+	Bytes    float64 // The number of bytes allowed each second, zero is unlimited.
+}
+
+// bucket is a token bucket that holds up to a second's worth of tokens. A take larger than
+// the bucket is allowed once the bucket is full, so it isn't refused forever.
+type bucket struct {
+	tokens float64   // The tokens currently in the bucket.
+	last   time.Time // When the bucket was last refilled.
+}
+
+func (b *bucket) take(rate float64, n float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens += rate * now.Sub(b.last).Seconds()
+		if b.tokens > rate {
+			b.tokens = rate
+		}
+	}
+	b.last = now
+
+	need := n
+	if need > rate {
+		need = rate
+	}
+
+	if b.tokens < need {
+		return false
+	}
+
+	b.tokens -= n
+	return true
+}
+
+// limiter tracks one kind of traffic against a RateLimit.
+type limiter struct {
+	messages bucket
+	bytes    bucket
+}
+
+func (l *limiter) allow(limit RateLimit, size int, now time.Time) bool {
+	m := l.messages.take(limit.Messages, 1, now)
+	b := l.bytes.take(limit.Bytes, float64(size), now)
+
+	return m && b
+}
+
+// SocketLimiter tracks the traffic of a single socket, it is only used by the messagePump
+// reading from that socket.
+type SocketLimiter struct {
+	announce limiter // Announces and resumes.
+	relay    limiter // Everything else.
+}
+
+type addressState struct {
+	announce    limiter   // Announces and resumes from every socket at the address.
+	relay       limiter   // Everything else from every socket at the address.
+	offences    int       // The number of times the address has exceeded a limit recently.
+	lastOffence time.Time // When the address last exceeded a limit.
+	bannedUntil time.Time // When the address may connect again.
+	lastSeen    time.Time // When the address last sent anything.
+}
+
+// RateLimiter tracks traffic across all the sockets from each remote address, and bans the
+// addresses that exceed their limits.
+type RateLimiter struct {
+	lock      sync.Mutex
+	config    Configuration            // The limits and ban durations to apply.
+	addresses map[string]*addressState // The traffic and bans of each remote address.
+	logger    *Logger                  // Where bans are logged.
+}
+
+func newRateLimiter(config Configuration, logger *Logger) *RateLimiter {
+	return &RateLimiter{config: config, addresses: make(map[string]*addressState), logger: logger}
+}
+
+// configure updates the limits and ban durations from config.
+func (r *RateLimiter) configure(config Configuration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.config = config
+}
+
+// isAnnounce returns true for messages that count against the announce limits.
+func isAnnounce(message string) bool {
+	command := splitFrame(message).Command
+	return command == "/announce" || command == "/resume"
+}
+
+// remoteHost strips the port from a remote address.
+func remoteHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	return host
+}
+
+// allow returns true if message, read from socket s at address, may be forwarded
+// to the signalbox. When it can't, the offence is held against the address.
+func (r *RateLimiter) allow(address string, s *SocketLimiter, message string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	a := r.address(address, now)
+	a.lastSeen = now
+
+	var allowed bool
+	if isAnnounce(message) {
+		allowed = s.announce.allow(r.config.SocketAnnounceLimit, len(message), now) &&
+			a.announce.allow(r.config.AddressAnnounceLimit, len(message), now)
+	} else {
+		allowed = s.relay.allow(r.config.SocketRelayLimit, len(message), now) &&
+			a.relay.allow(r.config.AddressRelayLimit, len(message), now)
+	}
+
+	if !allowed {
+		r.offend(address, a, now)
+	}
+
+	return allowed
+}
+
+// offend records an offence against address. Repeat offenders are kept from connecting,
+// doubling the length of the ban for each recent offence.
+func (r *RateLimiter) offend(address string, a *addressState, now time.Time) {
+	if now.Sub(a.lastOffence) > offenceMemory {
+		a.offences = 0
+	}
+	a.offences++
+	a.lastOffence = now
+
+	if r.config.BanDuration <= 0 || a.offences <= offencesBeforeBan {
+		r.logger.Info("Address exceeded rate limits", "address", address, "offences", a.offences)
+		return
+	}
+
+	doublings := uint(a.offences - offencesBeforeBan - 1)
+	if doublings > maxBanDoublings {
+		doublings = maxBanDoublings
+	}
+
+	duration := time.Duration(r.config.BanDuration) << doublings
+	if r.config.MaxBanDuration > 0 && duration > time.Duration(r.config.MaxBanDuration) {
+		duration = time.Duration(r.config.MaxBanDuration)
+	}
+
+	a.bannedUntil = now.Add(duration)
+	r.logger.Warn("Banned address for exceeding rate limits", "address", address, "offences", a.offences, "duration", duration)
+}
+
+// banned returns true if sockets from address should be refused.
+func (r *RateLimiter) banned(address string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	a, exists := r.addresses[address]
+	return exists && time.Now().Before(a.bannedUntil)
+}
+
+// address returns the state for address, forgetting idle addresses when too many are tracked.
+func (r *RateLimiter) address(address string, now time.Time) *addressState {
+	a, exists := r.addresses[address]
+	if exists {
+		return a
+	}
+
+	if len(r.addresses) >= rateLimiterSweepSize {
+		for k, s := range r.addresses {
+			if now.After(s.bannedUntil) && now.Sub(s.lastSeen) > time.Minute && now.Sub(s.lastOffence) > offenceMemory {
+				delete(r.addresses, k)
+			}
+		}
+	}
+
+	a = &addressState{}
+	r.addresses[address] = a
+	return a
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// The settings that only take effect when signalbox is restarted.
+var restartSettings = []string{"ListenAddress", "AdminAddress", "AdminToken", "CertFile", "KeyFile"}
+
+// LiveConfig holds the configuration (and the authenticator built from it) for everything
+// that reads it per connection or per message, rather than keeping a copy of its own.
+type LiveConfig struct {
+	lock   sync.RWMutex
+	config Configuration // The current configuration.
+	auth   Authenticator // The authenticator for the current configuration.
+}
+
+func newLiveConfig(config Configuration, auth Authenticator) *LiveConfig {
+	return &LiveConfig{config: config, auth: auth}
+}
+
+func (l *LiveConfig) get() (Configuration, Authenticator) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return l.config, l.auth
+}
+
+// set replaces the configuration, returning the one it replaced.
+func (l *LiveConfig) set(config Configuration, auth Authenticator) Configuration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	old := l.config
+	l.config = config
+	l.auth = auth
+
+	return old
+}
+
+// requiresRestart returns the names of the settings that differ between old and updated, but
+// can't change while signalbox is running.
+func requiresRestart(old Configuration, updated Configuration) []string {
+	changed := []string{}
+	o := reflect.ValueOf(old)
+	n := reflect.ValueOf(updated)
+
+	for _, s := range restartSettings {
+		if !reflect.DeepEqual(o.FieldByName(s).Interface(), n.FieldByName(s).Interface()) {
+			changed = append(changed, s)
+		}
+	}
+
+	return changed
+}
+
+// keepRestartSettings returns updated, with the settings that need a restart taken from old.
+func keepRestartSettings(old Configuration, updated Configuration) Configuration {
+	o := reflect.ValueOf(old)
+	n := reflect.ValueOf(&updated).Elem()
+
+	for _, s := range restartSettings {
+		n.FieldByName(s).Set(o.FieldByName(s))
+	}
+
+	return updated
+}
+
+// Reload applies config to the running server without touching existing connections. The
+// settings that need a restart keep their current values, and the current configuration is
+// kept if config can't be used.
+func (s *Server) Reload(config Configuration) error {
+	err := config.validate()
+	if err != nil {
+		return err
+	}
+
+	auth, err := newAuthenticator(config, s.logger)
+	if err != nil {
+		return err
+	}
+
+	current, _ := s.live.get()
+	for _, setting := range requiresRestart(current, config) {
+		s.logger.Warn("Setting requires a restart to change", "setting", setting)
+	}
+	config = keepRestartSettings(current, config)
+
+	s.live.set(config, auth)
+	s.logger.configure(config)
+	s.limits.configure(config)
+	s.connections.configure(config)
+	s.drainer.configure(config)
+	inSignalBox(s.msg, func(state SignalBox) (SignalBox, adminReply) {
+		state.config = config
+		return state, adminReply{http.StatusOK, nil}
+	})
+
+	// Renewed certificates are picked up along with everything else.
+	if s.certificates != nil {
+		err = s.certificates.reload()
+		if err != nil {
+			s.logger.Error("Unable to reload certificate - keeping the old one", "file", config.CertFile, "err", err)
+		}
+	}
+
+	s.logger.Info("Reloaded configuration")
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The machine-readable codes carried by an /error reply.
+const (
+	CodeInvalidMessage = "invalid-message" // The message couldn't be parsed.
+	CodeNotAnnounced   = "not-announced"   // The socket has to announce before it can send the message.
+	CodeWrongPeer      = "wrong-peer"      // The message names a peer other than the one the socket is bound to.
+	CodePeerTaken      = "peer-taken"      // The peer id belongs to another socket, or is waiting to resume.
+	CodeUnknownPeer    = "unknown-peer"    // The peer named by the message doesn't exist.
+	CodeNotInRoom      = "not-in-room"     // The peer isn't in the room named by the message.
+	CodeRoomLocked     = "room-locked"     // The room is locked to new peers.
+	CodeRoomFull       = "room-full"       // The room is at its peer limit.
+	CodeTooManyRooms   = "too-many-rooms"  // The peer is at its room limit.
+	CodeInvalidToken   = "invalid-token"   // The resume token doesn't match the peer.
+	CodeUnauthorized   = "unauthorized"    // The authenticator refused the announce.
+	CodeRateLimited    = "rate-limited"    // The socket sent too much, too quickly.
+	CodeOverCapacity   = "over-capacity"   // The address has too many sockets open.
+	CodeNotDelivered   = "not-delivered"   // A personalised message couldn't be written to its recipient.
+	CodeInternalError  = "internal-error"  // The signalbox failed while handling the message.
+)
+
+// The delivery status carried by a /receipt.
+const (
+	ReceiptDelivered   = "delivered"    // The message was handed to the recipient's connection.
+	ReceiptQueued      = "queued"       // The recipient is waiting to resume, and gets the message if it does.
+	ReceiptUnknownPeer = "unknown-peer" // The recipient doesn't exist, or doesn't share a room with the sender.
+	ReceiptFailed      = "failed"       // The message couldn't be written to the recipient.
+)
+
+// ProtocolError is a failure that is reported back to the peer that caused it.
+type ProtocolError struct {
+	Code    string // The machine-readable code, like CodeRoomFull.
+	Message string // The human readable description of what went wrong.
+}
+
+func (e ProtocolError) Error() string {
+	return e.Message
+}
+
+// protocolError builds a ProtocolError with code, formatting the message like fmt.Sprintf.
+func protocolError(code string, format string, args ...interface{}) error {
+	return ProtocolError{code, fmt.Sprintf(format, args...)}
+}
+
+// asProtocolError returns err as a ProtocolError, anything that isn't already one is treated as
+// an invalid message.
+func asProtocolError(err error) ProtocolError {
+	if e, ok := err.(ProtocolError); ok {
+		return e
+	}
+
+	return ProtocolError{CodeInvalidMessage, err.Error()}
+}
+
+// ErrorReply is the JSON carried by an /error, telling a peer why its message was rejected.
+type ErrorReply struct {
+	Id      string `json:"id,omitempty"` // The request id the rejected message carried.
+	Code    string `json:"code"`         // The machine-readable reason, like CodeRoomFull.
+	Command string `json:"command"`      // The command that was rejected, like "/announce".
+	Message string `json:"message"`      // The human readable reason.
+}
+
+// Ack is the JSON carried by an /ack, telling a peer that a message it sent with a request id
+// was handled.
+type Ack struct {
+	Id      string `json:"id"`      // The request id the message carried.
+	Command string `json:"command"` // The command that was handled, like "/announce".
+}
+
+// Receipt is the JSON carried by a /receipt, telling a peer that asked for receipts what
+// happened to a personalised message it sent.
+type Receipt struct {
+	Id     string `json:"id,omitempty"` // The request id the message carried.
+	To     string `json:"to"`           // The peer the message was sent to.
+	Status string `json:"status"`       // What happened to the message, like ReceiptDelivered.
+}
+
+// reject reports err back across the socket that sent message, returning it as a ProtocolError
+// so that it can also be logged by the signalbox.
+func reject(sourceSocket *Connection, message ParsedMessage, err error) error {
+	e := asProtocolError(err)
+	writeMessage(sourceSocket, errorMessage(message.RequestId, message.Command, e))
+
+	return e
+}
+
+// errorMessage builds the /error sent to a peer when its command fails.
+func errorMessage(requestId string, command string, err error) []string {
+	e := asProtocolError(err)
+	reply, _ := json.Marshal(ErrorReply{requestId, e.Code, command, e.Message})
+
+	return []string{"/error", string(reply)}
+}
+
+// ackMessage builds the /ack sent to a peer once a message carrying a request id is handled.
+func ackMessage(message ParsedMessage) []string {
+	reply, _ := json.Marshal(Ack{message.RequestId, message.Command})
+
+	return []string{"/ack", string(reply)}
+}
+
+// receiptMessage builds the /receipt sent to a peer once its personalised message has been
+// dealt with.
+func receiptMessage(message ParsedMessage, status string) []string {
+	reply, _ := json.Marshal(Receipt{message.RequestId, message.Peer, status})
+
+	return []string{"/receipt", string(reply)}
+}
+
+// splitRequestId strips the optional request id prefix (#<id>|) from message.
+func splitRequestId(message string) (requestId string, rest string) {
+	if !strings.HasPrefix(message, "#") {
+		return "", message
+	}
+
+	parts := strings.SplitN(message[1:], "|", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
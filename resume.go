@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+type Resume struct {
+	Token string `json:"token"` // The resume token the peer was issued.
+}
+
+type Resumed struct {
+	Token string              `json:"token"` // The token to use the next time the peer needs to resume.
+	Rooms map[string]RoomInfo `json:"rooms"` // Who is in each of the rooms the peer is inside.
+}
+
+func newResumeToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// holdPeer keeps source in all of its rooms after its connection has dropped, giving it
+// the reconnect window to resume before everyone else is told that it has left.
+func holdPeer(source *Peer, state SignalBox) SignalBox {
+	state.logger.Info("Holding peer", "peer", source.Id)
+	source.socket = nil
+	source.disconnected = true
+
+	if state.events != nil {
+		expiry := strings.Join([]string{"/expire", source.Id, source.token}, "|")
+		events := state.events
+
+		source.expiry = time.AfterFunc(time.Duration(state.config.ReconnectWindow), func() {
+			events.send(Message{nil, expiry, expire})
+		})
+	}
+
+	return state
+}
+
+// expire is raised by the signalbox once the reconnect window for a held peer has passed.
+func expire(message ParsedMessage,
+	sourceSocket *Connection,
+	state SignalBox) (newState SignalBox, err error) {
+
+	if message.Payload == "" {
+		return state, errors.New("Not enough parts to expire message")
+	}
+
+	// The peer has either resumed (and been issued a new token) or already left.
+	peer, exists := state.Peers[message.Peer]
+	if !exists || !peer.disconnected || peer.token != message.Payload {
+		return state, nil
+	}
+
+	state.logger.Info("Expiring peer", "peer", peer.Id)
+	return leaveAllRooms(peer, state)
+}
+
+func resume(message ParsedMessage,
+	sourceSocket *Connection,
+	state SignalBox) (newState SignalBox, err error) {
+
+	if message.Payload == "" {
+		return state, reject(sourceSocket, message, errors.New("Not enough parts to resume message"))
+	}
+
+	var r Resume
+	err = json.Unmarshal([]byte(message.Payload), &r)
+	if err != nil {
+		return state, reject(sourceSocket, message, err)
+	}
+
+	if sourceSocket != nil && sourceSocket.id != "" && sourceSocket.id != message.Peer {
+		err = protocolError(CodeWrongPeer, "Unable to resume, socket is already bound to %s", sourceSocket.id)
+		return state, reject(sourceSocket, message, err)
+	}
+
+	peer, exists := state.Peers[message.Peer]
+	if !exists || peer.token == "" || subtle.ConstantTimeCompare([]byte(peer.token), []byte(r.Token)) != 1 {
+		err = protocolError(CodeInvalidToken, "Unable to resume, invalid token for peer %s", message.Peer)
+		return state, reject(sourceSocket, message, err)
+	}
+
+	// The old connection might not have noticed that it is dead yet.
+	if peer.socket != sourceSocket {
+		peer.socket.Close()
+	}
+
+	state.logger.Info("Resuming peer", "peer", peer.Id)
+	if peer.expiry != nil {
+		peer.expiry.Stop()
+		peer.expiry = nil
+	}
+	peer.socket = sourceSocket
+	peer.disconnected = false
+	if sourceSocket != nil {
+		sourceSocket.id = peer.Id
+	}
+
+	peer.token, err = newResumeToken()
+	if err != nil {
+		return state, err
+	}
+
+	// Let the peer know who is in each of its rooms, then deliver what it missed.
+	resumed := Resumed{peer.token, make(map[string]RoomInfo)}
+	for _, r := range state.PeerIsIn[peer.Id] {
+		resumed.Rooms[r.Room] = roomInfo(peer, r, state)
+	}
+
+	b, err := json.Marshal(resumed)
+	if err != nil {
+		return state, err
+	}
+	err = writeMessage(sourceSocket, []string{"/resumed", string(b)})
+
+	for _, m := range peer.pending {
+		if e := writeMessage(sourceSocket, m); e != nil && err == nil {
+			err = e
+		}
+	}
+	peer.pending = nil
+
+	return state, err
+}
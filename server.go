@@ -0,0 +1,273 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Server is a signalbox that can be embedded in another Go program. It serves websockets (along
+// with /metrics and /rtc.io/primus.js) as an http.Handler, so it can be mounted on an existing
+// mux, or it can listen on ListenAddress by itself with Start.
+type Server struct {
+	lock         sync.Mutex
+	config       Configuration        // The configuration the server was created with.
+	live         *LiveConfig          // The configuration read per connection and per message.
+	msg          *mailbox             // The signalbox.
+	logger       *Logger              // Where the server logs what it is doing.
+	metrics      *Metrics             // The metrics served on /metrics.
+	limits       *RateLimiter         // The rate limits being applied.
+	connections  *ConnectionCounter   // The connection caps being applied.
+	drainer      *Drainer             // How to drain the signalbox.
+	certificates *CertificateReloader // The certificate to serve wss:// with, nil serves ws://.
+	mux          *http.ServeMux       // Routes requests to the websocket, metrics and primus handlers.
+	servers      []*http.Server       // The listeners started by Start.
+	stop         chan struct{}        // Closed to stop watching for renewed certificates.
+}
+
+// NewServer creates a signalbox from config, ready to be started or mounted on a mux.
+func NewServer(config Configuration) (*Server, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	logger := newLogger(config, os.Stderr)
+
+	auth, err := newAuthenticator(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{config: config,
+		live:        newLiveConfig(config, auth),
+		msg:         newMailbox(),
+		logger:      logger,
+		metrics:     newMetrics(),
+		limits:      newRateLimiter(config, logger),
+		connections: newConnectionCounter(config),
+		mux:         http.NewServeMux(),
+		stop:        make(chan struct{})}
+	s.drainer = newDrainer(config, s.msg, logger)
+
+	if config.CertFile != "" && config.KeyFile != "" {
+		s.certificates, err = newCertificateReloader(config.CertFile, config.KeyFile, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	state := newSignalBox(config, s.msg)
+	state.logger = s.logger
+	state.metrics = s.metrics
+	go signalbox(state)
+
+	s.mux.HandleFunc("/", s.serveWebsocket)
+	s.mux.Handle("/metrics", s.metrics)
+	s.mux.HandleFunc("/rtc.io/primus.js", func(w http.ResponseWriter, r *http.Request) {
+		s.logger.Debug("Serving primus.js file") // Hope to deprecate this with the latest version rtc.io signalling protocol changes.
+		w.Header().Set("Content-Type", "text/javascript")
+		fmt.Fprintf(w, primus_content)
+	})
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Logger returns where the server logs what it is doing, so that embedding programs can log
+// in the same format and at the same level.
+func (s *Server) Logger() *Logger {
+	return s.logger
+}
+
+// Start listens on ListenAddress (with TLS when a certificate is configured) and AdminAddress,
+// serving them in the background until Shutdown.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.config.ListenAddress)
+	if err != nil {
+		return err
+	}
+
+	if s.certificates != nil {
+		listener = tls.NewListener(listener, &tls.Config{GetCertificate: s.certificates.GetCertificate})
+		go s.certificates.watch(s.stop)
+	}
+
+	s.logger.Info("Started SignalBox", "address", s.config.ListenAddress)
+	s.serve(&http.Server{Handler: s}, listener)
+
+	if s.config.AdminAddress != "" {
+		listener, err = net.Listen("tcp", s.config.AdminAddress)
+		if err != nil {
+			s.Shutdown(context.Background())
+			return err
+		}
+
+		s.logger.Info("Serving admin API", "address", s.config.AdminAddress)
+		s.serve(&http.Server{Handler: adminHandler(s.config, s.msg, s.drainer, s.logger)}, listener)
+	}
+
+	return nil
+}
+
+func (s *Server) serve(server *http.Server, listener net.Listener) {
+	s.lock.Lock()
+	s.servers = append(s.servers, server)
+	s.lock.Unlock()
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Error("Unable to serve", "address", listener.Addr(), "err", err)
+		}
+	}()
+}
+
+// Shutdown drains the signalbox, hinting peers to reconnect elsewhere when configured, then
+// stops the signalbox and the listeners started by Start. Cancelling ctx cuts the drain short.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.logger.Info("Shutting down")
+	s.drainer.start()
+	s.drainer.drain(ctx)
+	s.msg.stop()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+
+	var err error
+	for _, server := range s.servers {
+		e := server.Shutdown(ctx)
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	s.servers = nil
+
+	return err
+}
+
+// serveWebsocket upgrades r to a websocket, and pumps messages between it and the signalbox.
+func (s *Server) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	// Settings can be reloaded at any time, new websockets pick up the latest ones.
+	config, _ := s.live.get()
+
+	origin := r.Header.Get("Origin")
+	if !originAllowed(config.AllowedOrigins, origin) {
+		s.logger.Warn("Rejected websocket from disallowed origin", "origin", origin, "remoteAddress", r.RemoteAddr)
+		http.Error(w, "Origin not allowed", 403)
+		return
+	}
+
+	if s.drainer.isDraining() {
+		http.Error(w, "Signalbox is draining", 503)
+		return
+	}
+
+	// Banned addresses are turned away before the upgrade, accept refuses any that get past.
+	if s.limits.banned(remoteHost(r.RemoteAddr)) {
+		s.logger.Warn("Rejected websocket from banned address", "remoteAddress", r.RemoteAddr)
+		http.Error(w, "Too many requests", 429)
+		return
+	}
+
+	// Upgrade the HTTP server connection to the WebSocket protocol.
+	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+	if err != nil {
+		s.logger.Error("Unable to upgrade connection", "remoteAddress", r.RemoteAddr, "err", err)
+		return
+	}
+
+	s.accept(newWebsocketTransport(ws), r.Header, r.URL.Query())
+}
+
+// Connect opens an in-memory connection to the signalbox, for tests and for peers running
+// in the same process. The connection is admitted like a websocket from remoteAddr, except
+// that it has no origin to check.
+func (s *Server) Connect(remoteAddr string) *MemoryConn {
+	t, conn := newMemoryPipe(remoteAddr)
+	s.accept(t, http.Header{}, url.Values{})
+
+	return conn
+}
+
+// accept pumps messages between the transport to a new peer and the signalbox.
+func (s *Server) accept(t Transport, header http.Header, query url.Values) {
+	config, _ := s.live.get()
+
+	s.metrics.socketOpened()
+	c := newConnection(config, t)
+	c.header = header
+	c.query = query
+	c.logger = s.logger
+	c.metrics = s.metrics
+
+	// Let the client know why it is being turned away, rather than just dropping it.
+	address := remoteHost(c.remoteAddr)
+	if s.limits.banned(address) {
+		s.logger.Warn("Rejected connection from banned address", "remoteAddress", c.remoteAddr)
+		c.CloseWith([]byte(strings.Join(errorMessage("", "connect", ProtocolError{CodeRateLimited, "Address is banned for exceeding rate limits"}), "|")))
+		go c.writePump()
+		return
+	}
+
+	err := s.connections.open(address)
+	if err != nil {
+		s.logger.Warn("Rejected connection over connection cap", "remoteAddress", c.remoteAddr, "err", err)
+		c.CloseWith([]byte(strings.Join(errorMessage("", "connect", ProtocolError{CodeOverCapacity, err.Error()}), "|")))
+		go c.writePump()
+		return
+	}
+
+	// Start pumping messages from this transport into the signal box, and
+	// anything queued for the peer back out to it.
+	if !s.drainer.add(c) {
+		c.CloseGoingAway("Signalbox is draining")
+	}
+
+	go func() {
+		c.writePump()
+		s.drainer.remove(c)
+		s.connections.close(address)
+	}()
+	go messagePump(s.live, s.limits, s.msg, c)
+}
@@ -17,30 +17,31 @@
  * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
  */
 
-package main
+package signalbox
 
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/gorilla/websocket"
-	"io"
-	"log"
-	"net/http"
-	"os"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
-const bufferSize int = 2048
-const maxMessageSize int = 20480 // Ensure that inbound messages don't cause the signalbox to run out of memory.
-
 type Peer struct {
-	Id     string          // The unique identifier of the peer.
-	socket *websocket.Conn // The socket for writing to the peer.
+	Id           string      // The unique identifier of the peer.
+	Announce     string      // The raw JSON the peer most recently announced itself with.
+	socket       *Connection // The connection for writing to the peer.
+	token        string      // The token that lets the peer resume on a new connection.
+	disconnected bool        // Is the peer being held while it waits to resume?
+	pending      [][]string  // Personalised messages waiting for the peer to resume.
+	receipts     bool        // Does the peer want a /receipt for each personalised message it sends?
+	expiry       *time.Timer // Expires the peer once its reconnect window has passed.
 }
 
 type Room struct {
-	Room string // The unique name of the room (id).
+	Room   string // The unique name of the room (id).
+	Locked bool   `json:"-"` // Is the room refusing entry to new peers?
 }
 
 type SignalBox struct {
@@ -48,62 +49,136 @@ type SignalBox struct {
 	Rooms        map[string]*Room            // All the rooms currently inside this signalbox.
 	RoomContains map[string]map[string]*Peer // All the peers currently inside a room.
 	PeerIsIn     map[string]map[string]*Room // All the rooms a peer is currently inside.
+	config       Configuration               // The configuration the signalbox is running with.
+	events       *mailbox                    // Where the signalbox raises messages for itself.
+	logger       *Logger                     // Where the signalbox logs what it is doing.
+	metrics      *Metrics                    // Where the signalbox counts what it has handled.
 }
 
 type Message struct {
-	msgSocket *websocket.Conn // The socket that the message was broadcast across.
-	msgBody   string          // The body of the broadcasted message.
+	msgSocket *Connection // The connection that the message was broadcast across.
+	msgBody   string      // The body of the broadcasted message.
+	msgAction messageFn   // Overrides the action for messages raised by the signalbox itself.
+}
+
+// mailbox carries messages to the signalbox goroutine, until the signalbox is stopped.
+type mailbox struct {
+	msg  chan Message  // Messages waiting for the signalbox.
+	done chan struct{} // Closed once the signalbox has been stopped.
+	once sync.Once     // Ensures that the signalbox is only stopped once.
 }
 
-func messagePump(config Configuration, msg chan Message, ws *websocket.Conn) {
-	ws.SetReadDeadline(time.Now().Add(config.SocketTimeout * time.Second))
-	ws.SetWriteDeadline(time.Now().Add(config.SocketTimeout * time.Second))
+func newMailbox() *mailbox {
+	return &mailbox{msg: make(chan Message), done: make(chan struct{})}
+}
+
+// send hands m to the signalbox, returning false if the signalbox has been stopped.
+func (m *mailbox) send(message Message) bool {
+	select {
+	case m.msg <- message:
+		return true
+
+	case <-m.done:
+		return false
+	}
+}
+
+// stop shuts down the signalbox, anything sent afterwards is discarded.
+func (m *mailbox) stop() {
+	m.once.Do(func() {
+		close(m.done)
+	})
+}
+
+func newSignalBox(config Configuration, msg *mailbox) SignalBox {
+	return SignalBox{make(map[string]*Peer),
+		make(map[string]*Room),
+		make(map[string]map[string]*Peer),
+		make(map[string]map[string]*Room),
+		config,
+		msg,
+		defaultLogger,
+		defaultMetrics}
+}
+
+func messagePump(live *LiveConfig, limits *RateLimiter, msg *mailbox, c *Connection) {
+	socket := c.socket
+	address := remoteHost(c.remoteAddr)
+	var socketLimits SocketLimiter
+	config, auth := live.get()
+	socket.SetReadDeadline(time.Now().Add(time.Duration(config.SocketTimeout)))
 
 	for {
-		_, reader, err := ws.NextReader()
+		socketContents, err := socket.ReadMessage()
+
+		if _, skip := err.(MessageError); skip {
+			c.logger.Error("Unable to read from socket", "socket", fmt.Sprintf("%p", socket), "err", err)
+			continue
+		}
 
 		if err != nil {
-			// Unable to get reader from socket - probably closed, tell the signalbox.
-			log.Printf("ERROR - messagePump: Can't read from %p, closing", ws)
-			log.Print(err)
-			msg <- Message{ws, "/close"}
+			// Unable to read from socket - probably closed, tell the signalbox.
+			c.logger.Info("Can't read from socket, closing", "socket", fmt.Sprintf("%p", socket), "err", err)
+			msg.send(Message{c, "/close", nil})
 
 			return
 		}
 
-		buffer := make([]byte, bufferSize)
-		n, err := reader.Read(buffer)
-		socketContents := string(buffer[0:n])
+		// Recieved content from socket - extend read deadline.
+		config, auth = live.get()
+		socket.SetReadDeadline(time.Now().Add(time.Duration(config.SocketTimeout)))
 
-		for err != io.EOF && (len(socketContents)-bufferSize) < maxMessageSize {
-			// filled the buffer - we might have more stuff in the message.
-			n, err = reader.Read(buffer)
-			socketContents = socketContents + string(buffer[0:n])
-		}
+		c.metrics.received(len(socketContents))
+		c.logger.Payload("Received message", socketContents, "socket", fmt.Sprintf("%p", socket))
 
-		if err != io.EOF {
-			log.Printf("ERROR - messagePump: Unable to read from websocket.")
-			log.Print(err)
-			continue
+		// Let the peer know why it is being disconnected before closing the socket.
+		if !limits.allow(address, &socketLimits, socketContents) {
+			c.logger.Warn("Rate limit exceeded, disconnecting", "remoteAddress", c.remoteAddr)
+			c.metrics.rateLimited()
+
+			frame := splitFrame(socketContents)
+			notice := errorMessage(frame.RequestId, frame.Command, protocolError(CodeRateLimited, "Rate limit exceeded, disconnecting"))
+			c.CloseWith([]byte(strings.Join(notice, "|")))
+			msg.send(Message{c, "/close", nil})
+
+			return
 		}
 
-		// Recieved content from socket - extend read deadline.
-		ws.SetReadDeadline(time.Now().Add(config.SocketTimeout * time.Second))
+		// Peers need to authenticate before their announce reaches the signalbox.
+		if frame := splitFrame(socketContents); auth != nil && frame.Command == "/announce" && utf8.ValidString(socketContents) {
+			message, err := authenticateAnnounce(auth, c, frame)
+			if err != nil {
+				c.logger.Warn("Rejected announce", "remoteAddress", c.remoteAddr, "err", err)
+				reject(c, message, ProtocolError{CodeUnauthorized, err.Error()})
+				continue
+			}
+			socketContents = message.String()
+		}
 
-		// Pump the new message into the signalbox.
-		log.Printf("Recieved %s from %p", socketContents, ws)
-		msg <- Message{ws, socketContents}
+		// Pump the new message into the signalbox, unless it has been stopped.
+		if !msg.send(Message{c, socketContents, nil}) {
+			return
+		}
 	}
 }
 
-func signalbox(config Configuration, msg chan Message) {
-	s := SignalBox{make(map[string]*Peer),
-		make(map[string]*Room),
-		make(map[string]map[string]*Peer),
-		make(map[string]map[string]*Room)}
-
+// signalbox handles the messages sent to s, one at a time, until its mailbox is stopped.
+func signalbox(s SignalBox) {
 	for {
-		m := <-msg
+		var m Message
+		select {
+		case m = <-s.events.msg:
+
+		case <-s.events.done:
+			// Held peers won't be expired by a signalbox that has stopped.
+			for _, p := range s.Peers {
+				if p.expiry != nil {
+					p.expiry.Stop()
+				}
+			}
+			return
+		}
+		start := time.Now()
 
 		// Message matches a primus heartbeat message. Lightly massage the connection
 		// with pong brand baby oil to keep everything running smoothly.
@@ -111,67 +186,49 @@ func signalbox(config Configuration, msg chan Message) {
 			pong := fmt.Sprintf("primus::pong::%s", strings.Split(m.msgBody, "primus::ping::")[1])
 			b, _ := json.Marshal(pong)
 
-			m.msgSocket.WriteMessage(websocket.TextMessage, b)
-			m.msgSocket.SetWriteDeadline(time.Now().Add(config.SocketTimeout * time.Second))
+			m.msgSocket.Write(b)
+			s.metrics.handled("ping", time.Since(start), s)
 			continue
 		}
 
 		action, messageBody, err := ParseMessage(m.msgBody)
 		if err != nil {
-			log.Printf("ERROR - signalbox: Unable to parse message.")
-			log.Print(err)
+			s.logger.Error("Unable to parse message", "err", err)
+			writeMessage(m.msgSocket, errorMessage("", "", err))
+			s.metrics.handled("parse_error", time.Since(start), s)
 			continue
 		}
 
+		command := commandName(messageBody)
+		if m.msgAction != nil {
+			action = m.msgAction
+			command = "internal"
+		}
+
 		s, err = action(messageBody, m.msgSocket, s)
 		if err != nil {
-			log.Printf("ERROR - signalbox: Unable to update state.")
-			log.Print(err)
+			s.logger.Error("Unable to update state", "command", messageBody.Command, "err", err)
 		}
-	}
-}
 
-func main() {
-	log.Printf("INFO - Started SignalBox\n")
+		_, rejected := err.(ProtocolError)
+		switch {
+		case m.msgAction != nil || rejected:
+			// Internal messages have nobody to answer, and rejected messages have already had an /error.
 
-	configFile := "signalbox.json"
-	if len(os.Args) > 1 {
-		configFile = os.Args[1]
-	}
-
-	config, err := parseConfiguration(configFile)
-	if err != nil {
-		log.Printf("ERROR - main: Unable to parse config %s - using defaults.", err)
-	}
+		case err != nil:
+			err = protocolError(CodeInternalError, "Unable to handle %s", messageBody.Command)
+			writeMessage(m.msgSocket, errorMessage(messageBody.RequestId, messageBody.Command, err))
 
-	msg := make(chan Message)
-	go signalbox(config, msg)
+		case messageBody.RequestId == "":
+			// Only messages that carry a request id are answered when they succeed.
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "GET" {
-			http.Error(w, "Method not allowed", 405)
-			return
-		}
+		case !strings.HasPrefix(messageBody.Command, "/"):
+			err = protocolError(CodeInvalidMessage, "Unable to handle %s, it isn't a command", messageBody.Command)
+			writeMessage(m.msgSocket, errorMessage(messageBody.RequestId, messageBody.Command, err))
 
-		// Upgrade the HTTP server connection to the WebSocket protocol.
-		ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
-		if err != nil {
-			log.Printf("ERROR - http.HandleFunc: %s", err)
-			return
+		default:
+			writeMessage(m.msgSocket, ackMessage(messageBody))
 		}
-
-		// Start pumping messages from this websocket into the signal box.
-		go messagePump(config, msg, ws)
-	})
-
-	http.HandleFunc("/rtc.io/primus.js", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("INFO - Serving primus.js file.")	// Hope to deprecate this with the latest version rtc.io signalling protocol changes.
-		w.Header().Set("Content-Type", "text/javascript")
-		fmt.Fprintf(w, primus_content)
-	})
-
-	err = http.ListenAndServe(config.ListenAddress, nil)
-	if err != nil {
-		panic("ListenAndServe: " + err.Error())
+		s.metrics.handled(command, time.Since(start), s)
 	}
 }
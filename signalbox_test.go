@@ -17,15 +17,37 @@
  * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
  */
 
-package main
+package signalbox
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/gorilla/websocket"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -39,7 +61,7 @@ var _ = Describe("Message", func() {
 	Context("Utf8 encoding", func() {
 		It("should return an error for non-utf8 encoded messages", func() {
 			_, _, err := ParseMessage(string([]byte{0xff, 0xfe, 0xfd}))
-			Ω(err).ShouldNot(BeNil())			
+			Ω(err).ShouldNot(BeNil())
 		})
 
 		It("should should not return an error for utf8 encoded messages", func() {
@@ -53,51 +75,75 @@ var _ = Describe("Message", func() {
 			action, message, err := ParseMessage("")
 			Ω(err).Should(BeNil())
 			Ω(runtime.FuncForPC(reflect.ValueOf(action).Pointer()).Name()).Should(Equal("github.com/cfreeman/signalbox.ignore"))
-			Ω(len(message)).Should(Equal(1))
+			Ω(message).Should(Equal(ParsedMessage{}))
 		})
 
 		It("should be able to parse an announce message", func() {
 			action, message, err := ParseMessage("/announce")
 			Ω(err).Should(BeNil())
 			Ω(runtime.FuncForPC(reflect.ValueOf(action).Pointer()).Name()).Should(Equal("github.com/cfreeman/signalbox.announce"))
-			Ω(len(message)).Should(Equal(1))
+			Ω(message).Should(Equal(ParsedMessage{Command: "/announce"}))
 		})
 
 		It("should be able to parse a leave message", func() {
 			action, message, err := ParseMessage("/leave")
 			Ω(err).Should(BeNil())
 			Ω(runtime.FuncForPC(reflect.ValueOf(action).Pointer()).Name()).Should(Equal("github.com/cfreeman/signalbox.leave"))
-			Ω(len(message)).Should(Equal(1))
+			Ω(message).Should(Equal(ParsedMessage{Command: "/leave"}))
 		})
 
 		It("should be able to parse a close message", func() {
 			action, message, err := ParseMessage("/close")
 			Ω(err).Should(BeNil())
 			Ω(runtime.FuncForPC(reflect.ValueOf(action).Pointer()).Name()).Should(Equal("github.com/cfreeman/signalbox.closePeer"))
-			Ω(len(message)).Should(Equal(1))
+			Ω(message).Should(Equal(ParsedMessage{Command: "/close"}))
 		})
 
 		It("should be able to parse a to message", func() {
 			action, message, err := ParseMessage("/to")
 			Ω(err).Should(BeNil())
 			Ω(runtime.FuncForPC(reflect.ValueOf(action).Pointer()).Name()).Should(Equal("github.com/cfreeman/signalbox.to"))
-			Ω(len(message)).Should(Equal(1))
+			Ω(message).Should(Equal(ParsedMessage{Command: "/to"}))
+		})
+
+		It("should be able to parse lock and unlock messages", func() {
+			action, _, err := ParseMessage("/lock")
+			Ω(err).Should(BeNil())
+			Ω(runtime.FuncForPC(reflect.ValueOf(action).Pointer()).Name()).Should(Equal("github.com/cfreeman/signalbox.lock"))
+
+			action, _, err = ParseMessage("/unlock")
+			Ω(err).Should(BeNil())
+			Ω(runtime.FuncForPC(reflect.ValueOf(action).Pointer()).Name()).Should(Equal("github.com/cfreeman/signalbox.unlock"))
 		})
 
 		It("should be able to parse a custom message", func() {
 			action, message, err := ParseMessage("/custom|part1|part2")
 			Ω(err).Should(BeNil())
 			Ω(runtime.FuncForPC(reflect.ValueOf(action).Pointer()).Name()).Should(Equal("github.com/cfreeman/signalbox.custom"))
-			Ω(len(message)).Should(Equal(3))
-			Ω(message[0]).Should(Equal("/custom"))
-			Ω(message[1]).Should(Equal("part1"))
-			Ω(message[2]).Should(Equal("part2"))
+			Ω(message).Should(Equal(ParsedMessage{Command: "/custom", Peer: "part1", Payload: "part2"}))
+		})
+
+		It("should keep pipes inside the payload", func() {
+			_, message, err := ParseMessage("/announce|a|{\"room\":\"test\",\"name\":\"a|b\"}")
+			Ω(err).Should(BeNil())
+			Ω(message).Should(Equal(ParsedMessage{Command: "/announce", Peer: "a", Payload: "{\"room\":\"test\",\"name\":\"a|b\"}"}))
+
+			_, message, err = ParseMessage("/to|b|/offer|{\"id\":\"a\"}|v=0|o=-")
+			Ω(err).Should(BeNil())
+			Ω(message.Peer).Should(Equal("b"))
+			Ω(message.Payload).Should(Equal("/offer|{\"id\":\"a\"}|v=0|o=-"))
+			Ω(message.String()).Should(Equal("/to|b|/offer|{\"id\":\"a\"}|v=0|o=-"))
+		})
+
+		It("should only frame the parts that are present", func() {
+			Ω(ParsedMessage{Command: "/hello", Peer: "a"}.String()).Should(Equal("/hello|a"))
+			Ω(ParsedMessage{Command: "/hello", Payload: "x"}.String()).Should(Equal("/hello||x"))
 		})
 
 		It("should ignore malformed messages", func() {
 			action, message, err := ParseMessage(":lkajsd??asdj/foo")
 			Ω(err).Should(BeNil())
-			Ω(len(message)).Should(Equal(1))
+			Ω(message).Should(Equal(ParsedMessage{Command: ":lkajsd??asdj/foo"}))
 			Ω(runtime.FuncForPC(reflect.ValueOf(action).Pointer()).Name()).Should(Equal("github.com/cfreeman/signalbox.ignore"))
 		})
 	})
@@ -109,6 +155,14 @@ var _ = Describe("Message", func() {
 			Ω(err).ShouldNot(BeNil())
 		})
 
+		It("should parse the room from an announce containing pipes", func() {
+			_, message, _ := ParseMessage("/announce|abc|{\"room\":\"test\",\"sdp\":\"a|b|c\"}")
+			source, destination, err := ParsePeerAndRoom(message)
+			Ω(err).Should(BeNil())
+			Ω(source.Id).Should(Equal("abc"))
+			Ω(destination.Room).Should(Equal("test"))
+		})
+
 		It("should parse source id and room", func() {
 			_, message, _ := ParseMessage("/announce|abc|{\"room\":\"test\"}")
 			source, destination, err := ParsePeerAndRoom(message)
@@ -123,43 +177,143 @@ var _ = Describe("Message", func() {
 			config, err := parseConfiguration("foo")
 			Ω(err).ShouldNot(BeNil())
 			Ω(config.ListenAddress).Should(Equal(":3000"))
-			Ω(config.SocketTimeout).Should(Equal(time.Duration(300) * time.Nanosecond))
+			Ω(config.SocketTimeout).Should(Equal(Duration(300 * time.Second)))
+			Ω(config.OutboundQueueSize).Should(Equal(256))
+			Ω(config.OutboundQueuePolicy).Should(Equal(Disconnect))
 		})
 
 		It("Should be able to parse a valid config file", func() {
 			config, err := parseConfiguration("testdata/test-config.json")
 			Ω(err).Should(BeNil())
 			Ω(config.ListenAddress).Should(Equal("10.1.2.3:4000"))
-			Ω(config.SocketTimeout).Should(Equal(time.Duration(200) * time.Nanosecond))
+			Ω(config.SocketTimeout).Should(Equal(Duration(200 * time.Second)))
+		})
+
+		It("Should accept durations as strings or seconds", func() {
+			var d Duration
+			Ω(json.Unmarshal([]byte(`"1m30s"`), &d)).Should(BeNil())
+			Ω(d).Should(Equal(Duration(90 * time.Second)))
+			Ω(json.Unmarshal([]byte(`45`), &d)).Should(BeNil())
+			Ω(d).Should(Equal(Duration(45 * time.Second)))
+			Ω(json.Unmarshal([]byte(`"soon"`), &d)).ShouldNot(BeNil())
+
+			b, _ := json.Marshal(Duration(30 * time.Second))
+			Ω(string(b)).Should(Equal(`"30s"`))
+		})
+
+		It("Should refuse unknown settings", func() {
+			config := DefaultConfiguration()
+			Ω(decodeStrict([]byte(`{"SocketTimeout":"30s"}`), &config)).Should(BeNil())
+			Ω(decodeStrict([]byte(`{"SocketTimout":"30s"}`), &config)).Should(Equal(errors.New("Unknown setting SocketTimout")))
+			Ω(decodeStrict([]byte(`{"SocketRelayLimit":{"Message":1}}`), &config)).Should(Equal(errors.New("Unknown setting SocketRelayLimit.Message")))
+			Ω(decodeStrict([]byte(`{"RoomLimits":[{"Room":"a","Max":1}]}`), &config)).Should(Equal(errors.New("Unknown setting RoomLimits.0.Max")))
+		})
+
+		It("Should refuse invalid settings", func() {
+			config := DefaultConfiguration()
+			Ω(config.validate()).Should(BeNil())
+
+			config.OutboundQueuePolicy = "drop-everything"
+			config.CertFile = "cert.pem"
+			config.MaxConnections = -1
+			config.SocketRelayLimit.Bytes = -1
+			config.DrainReconnectURL = "elsewhere"
+			Ω(config.validate()).Should(Equal(errors.New("OutboundQueuePolicy must be drop-oldest, drop-newest or disconnect; " +
+				"CertFile and KeyFile must be set together; " +
+				"DrainReconnectURL must be an absolute URL; " +
+				"SocketRelayLimit.Bytes can't be negative; " +
+				"MaxConnections can't be negative")))
+		})
+
+		It("Should layer environment variables and flags over the file", func() {
+			options, err := ParseOptions([]string{"--socket-timeout", "10s", "--allowed-origins", "https://a.com, https://b.com", "testdata/test-config.json"})
+			Ω(err).Should(BeNil())
+			Ω(options.ConfigFile).Should(Equal("testdata/test-config.json"))
+
+			config, err := LoadConfiguration(options, []string{"SIGNALBOX_SOCKET_TIMEOUT=20s",
+				"SIGNALBOX_AUTH_JWT_SECRET_FILE=secret",
+				"SIGNALBOX_SOCKET_RELAY_LIMIT={\"Messages\":5}",
+				"HOME=/root"})
+			Ω(err).Should(BeNil())
+			Ω(config.ListenAddress).Should(Equal("10.1.2.3:4000"))
+			Ω(config.SocketTimeout).Should(Equal(Duration(10 * time.Second)))
+			Ω(config.AuthJWTSecretFile).Should(Equal("secret"))
+			Ω(config.SocketRelayLimit).Should(Equal(RateLimit{Messages: 5}))
+			Ω(config.AllowedOrigins).Should(Equal([]string{"https://a.com", "https://b.com"}))
+		})
+
+		It("Should refuse to start with a bad file, variable or flag", func() {
+			_, err := ParseOptions([]string{"--socket-timout", "10s"})
+			Ω(err).ShouldNot(BeNil())
+
+			options, _ := ParseOptions([]string{"--config", "foo"})
+			_, err = LoadConfiguration(options, nil)
+			Ω(err).ShouldNot(BeNil())
+
+			options, _ = ParseOptions(nil)
+			_, err = LoadConfiguration(options, []string{"SIGNALBOX_SOCKET_TIMOUT=10s"})
+			Ω(err).Should(Equal(errors.New("Unknown setting SIGNALBOX_SOCKET_TIMOUT")))
+
+			options, _ = ParseOptions([]string{"--max-connections", "lots"})
+			_, err = LoadConfiguration(options, nil)
+			Ω(err).ShouldNot(BeNil())
+		})
+
+		It("Should accept bool settings as bare flags", func() {
+			options, err := ParseOptions([]string{"--reload-on-change", "--print-config"})
+			Ω(err).Should(BeNil())
+			Ω(options.PrintConfig).Should(BeTrue())
+			Ω(options.Overrides["ReloadOnChange"]).Should(Equal("true"))
+
+			options, err = ParseOptions([]string{"--reload-on-change=false"})
+			Ω(err).Should(BeNil())
+			Ω(options.Overrides["ReloadOnChange"]).Should(Equal("false"))
+		})
+
+		It("Should report when help was asked for", func() {
+			_, err := ParseOptions([]string{"--help"})
+			Ω(err).Should(Equal(flag.ErrHelp))
+		})
+
+		It("Should name flags and environment variables after their settings", func() {
+			Ω(flagName("SocketTimeout")).Should(Equal("socket-timeout"))
+			Ω(flagName("AuthJWTSecretFile")).Should(Equal("auth-jwt-secret-file"))
+			Ω(envName("AuthWebhookURL")).Should(Equal("SIGNALBOX_AUTH_WEBHOOK_URL"))
+		})
+
+		It("Should print the configuration without the admin token", func() {
+			config := DefaultConfiguration()
+			config.AdminToken = "secret"
+
+			printed := FormatConfiguration(config)
+			Ω(printed).ShouldNot(ContainSubstring("secret"))
+			Ω(printed).Should(ContainSubstring(`"SocketTimeout": "5m0s"`))
 		})
 	})
 
 	Context("Test SignalBox State", func() {
 		var state SignalBox
 		var announceAAct messageFn
-		var announceAMsg []string
+		var announceAMsg ParsedMessage
 
 		var announceA2Act messageFn
-		var announceA2Msg []string
+		var announceA2Msg ParsedMessage
 
 		var leaveAAct messageFn
-		var leaveAMsg []string
+		var leaveAMsg ParsedMessage
 
 		var leaveA2Act messageFn
-		var leaveA2Msg []string
+		var leaveA2Msg ParsedMessage
 
 		var announceBAct messageFn
-		var announceBMsg []string
+		var announceBMsg ParsedMessage
 
 		var leaveBAct messageFn
-		var leaveBMsg []string
+		var leaveBMsg ParsedMessage
 
 		BeforeEach(func() {
 			var err error
-			state = SignalBox{make(map[string]*Peer),
-				make(map[string]*Room),
-				make(map[string]map[string]*Peer),
-				make(map[string]map[string]*Room)}
+			state = newSignalBox(Configuration{}, nil)
 
 			announceAAct, announceAMsg, err = ParseMessage("/announce|a|{\"room\":\"test\"}")
 			Ω(err).Should(BeNil())
@@ -243,127 +397,1806 @@ var _ = Describe("Message", func() {
 			Ω(state.RoomContains["test"]["a"].Id).Should(Equal("a"))
 			Ω(state.RoomContains["test2"]["a"].Id).Should(Equal("a"))
 		})
+
+		It("Should only remove a person from the room they leave", func() {
+			state, err := announceAAct(announceAMsg, nil, state)
+			Ω(err).Should(BeNil())
+			state, err = announceA2Act(announceA2Msg, nil, state)
+			Ω(err).Should(BeNil())
+			state, err = leaveA2Act(leaveA2Msg, nil, state)
+			Ω(err).Should(BeNil())
+
+			Ω(len(state.Peers)).Should(Equal(1))
+			Ω(len(state.Rooms)).Should(Equal(1))
+			Ω(len(state.PeerIsIn["a"])).Should(Equal(1))
+			Ω(state.PeerIsIn["a"]["test"].Room).Should(Equal("test"))
+		})
 	})
 
-	Context("Broadcast messages", func() {
-		// Spin up the signalbox.
-		go main()
+	Context("Peer identity", func() {
+		var state SignalBox
+		var a, b *Connection
 
-		It("Should be to send announce and leave messages to peers", func() {
-			a, err := connectPeer("a", "test-room")
+		BeforeEach(func() {
+			state = newSignalBox(Configuration{}, nil)
+
+			config, _ := parseConfiguration("foo")
+			a = newConnection(config, nil)
+			b = newConnection(config, nil)
+
+			action, message, _ := ParseMessage("/announce|a|{\"room\":\"test\"}")
+			state, _ = action(message, a, state)
+			Ω(a.id).Should(Equal("a"))
+			Ω(string(<-a.outbound)).Should(Equal("/roominfo|{\"memberCount\":1,\"members\":[]}"))
+		})
+
+		It("Should reject messages that claim to be from another peer", func() {
+			action, message, _ := ParseMessage("/announce|b|{\"room\":\"test\"}")
+			state, _ = action(message, b, state)
+
+			action, message, _ = ParseMessage("/leave|a|{\"room\":\"test\"}")
+			state, err := action(message, b, state)
+			Ω(err).ShouldNot(BeNil())
+			Ω(len(state.RoomContains["test"])).Should(Equal(2))
+
+			Ω(string(<-b.outbound)).Should(Equal("/roominfo|{\"memberCount\":2,\"members\":[{\"id\":\"a\",\"data\":{\"room\":\"test\"}}]}"))
+			Ω(string(<-b.outbound)).Should(Equal("/error|{\"code\":\"wrong-peer\",\"command\":\"/leave\",\"message\":\"Message claims to be from a, but socket is bound to b\"}"))
+		})
+
+		It("Should reject 'to' messages that claim to be from another peer", func() {
+			action, message, _ := ParseMessage("/announce|b|{\"room\":\"test\"}")
+			state, _ = action(message, b, state)
+			<-a.outbound
+			<-b.outbound
+
+			action, message, _ = ParseMessage("/to|a|/offer|{\"id\":\"z\"}")
+			state, err := action(message, b, state)
+			Ω(err).ShouldNot(BeNil())
+			Ω(len(a.outbound)).Should(Equal(0))
+			Ω(string(<-b.outbound)).Should(Equal("/error|{\"code\":\"wrong-peer\",\"command\":\"/to\",\"message\":\"Message claims to be from z, but socket is bound to b\"}"))
+
+			action, message, _ = ParseMessage("/to|a|/offer|{\"id\":\"b\"}")
+			state, err = action(message, b, state)
 			Ω(err).Should(BeNil())
-			socketShouldContain(a, "/roominfo|{\"memberCount\":1}")
+			Ω(string(<-a.outbound)).Should(Equal("/to|a|/offer|{\"id\":\"b\"}"))
+		})
+
+		It("Should reject custom messages from sockets that haven't announced", func() {
+			action, message, _ := ParseMessage("/hello|a")
+			_, err := action(message, b, state)
+			Ω(err).ShouldNot(BeNil())
+			Ω(len(a.outbound)).Should(Equal(0))
+			Ω(len(b.outbound)).Should(Equal(1))
+		})
+
+		It("Should refuse to let another socket take over a live peer", func() {
+			action, message, _ := ParseMessage("/announce|a|{\"room\":\"test2\"}")
+			state, err := action(message, b, state)
+			Ω(err).ShouldNot(BeNil())
+			Ω(b.id).Should(Equal(""))
+			Ω(state.Peers["a"].socket).Should(Equal(a))
+			Ω(len(state.Rooms)).Should(Equal(1))
+		})
+
+		It("Should let another socket take over a peer whose socket has closed", func() {
+			a.Close()
 
-			b, err := connectPeer("b", "test-room")
+			action, message, _ := ParseMessage("/announce|a|{\"room\":\"test\"}")
+			state, err := action(message, b, state)
 			Ω(err).Should(BeNil())
-			socketShouldContain(b, "/roominfo|{\"memberCount\":2}")
+			Ω(b.id).Should(Equal("a"))
+			Ω(state.Peers["a"].socket).Should(Equal(b))
+		})
 
-			socketShouldContain(a, "/announce|b|{\"room\":\"test-room\"}")
+		It("Should leave a peer whose socket has closed alone when the new socket's announce is refused", func() {
+			a.Close()
+			state.Rooms["locked"] = &Room{Room: "locked", Locked: true}
 
-			socketSend(a, "/leave|a|{\"room\":\"test-room\"}")
-			err = a.Close()
+			action, message, _ := ParseMessage("/announce|a|{\"room\":\"locked\"}")
+			state, err := action(message, b, state)
+			Ω(err).ShouldNot(BeNil())
+			Ω(b.id).Should(Equal(""))
+			Ω(state.Peers["a"].socket).Should(Equal(a))
+		})
+
+		It("Should refuse to let a socket announce as a different peer", func() {
+			action, message, _ := ParseMessage("/announce|c|{\"room\":\"test\"}")
+			state, err := action(message, a, state)
+			Ω(err).ShouldNot(BeNil())
+			Ω(a.id).Should(Equal("a"))
+			Ω(len(state.Peers)).Should(Equal(1))
+		})
+	})
+
+	Context("Room locking", func() {
+		var state SignalBox
+		var a, b *Connection
+
+		BeforeEach(func() {
+			state = newSignalBox(Configuration{}, nil)
+
+			config, _ := parseConfiguration("foo")
+			a = newConnection(config, nil)
+			b = newConnection(config, nil)
+
+			action, message, _ := ParseMessage("/announce|a|{\"room\":\"test\"}")
+			state, _ = action(message, a, state)
+			<-a.outbound
+		})
+
+		It("Should refuse entry to a locked room", func() {
+			action, message, _ := ParseMessage("/lock|a|{\"room\":\"test\"}")
+			state, err := action(message, a, state)
 			Ω(err).Should(BeNil())
+			Ω(state.Rooms["test"].Locked).Should(BeTrue())
+			Ω(string(<-a.outbound)).Should(Equal("/lock|a|{\"room\":\"test\"}"))
 
-			socketShouldContain(b, "/leave|a|{\"room\":\"test-room\"}")
-			err = b.Close()
+			action, message, _ = ParseMessage("/announce|b|{\"room\":\"test\"}")
+			state, err = action(message, b, state)
+			Ω(err).ShouldNot(BeNil())
+			Ω(len(state.RoomContains["test"])).Should(Equal(1))
+			Ω(string(<-b.outbound)).Should(Equal("/error|{\"code\":\"room-locked\",\"command\":\"/announce\",\"message\":\"Unable to announce, room test is locked\"}"))
+		})
+
+		It("Should still let existing members announce into a locked room", func() {
+			action, message, _ := ParseMessage("/lock|a|{\"room\":\"test\"}")
+			state, _ = action(message, a, state)
+
+			action, message, _ = ParseMessage("/announce|a|{\"room\":\"test\"}")
+			_, err := action(message, a, state)
 			Ω(err).Should(BeNil())
 		})
 
-		It("Should be able to send messages just to specified recipients", func() {
-			a2, err := connectPeer("a2", "to-test")
+		It("Should let peers into a room once it has been unlocked", func() {
+			action, message, _ := ParseMessage("/lock|a|{\"room\":\"test\"}")
+			state, _ = action(message, a, state)
+			action, message, _ = ParseMessage("/unlock|a|{\"room\":\"test\"}")
+			state, err := action(message, a, state)
 			Ω(err).Should(BeNil())
-			socketShouldContain(a2, "/roominfo|{\"memberCount\":1}")
+			Ω(state.Rooms["test"].Locked).Should(BeFalse())
 
-			b2, err := connectPeer("b2", "to-test")
+			action, message, _ = ParseMessage("/announce|b|{\"room\":\"test\"}")
+			state, err = action(message, b, state)
 			Ω(err).Should(BeNil())
-			socketShouldContain(b2, "/roominfo|{\"memberCount\":2}")
+			Ω(len(state.RoomContains["test"])).Should(Equal(2))
+		})
+
+		It("Should only let members of a room lock it", func() {
+			action, message, _ := ParseMessage("/announce|b|{\"room\":\"test2\"}")
+			state, _ = action(message, b, state)
+
+			action, message, _ = ParseMessage("/lock|b|{\"room\":\"test\"}")
+			state, err := action(message, b, state)
+			Ω(err).ShouldNot(BeNil())
+			Ω(state.Rooms["test"].Locked).Should(BeFalse())
+		})
+	})
+
+	Context("Custom messages", func() {
+		var state SignalBox
+		var a, b, c *Connection
+
+		BeforeEach(func() {
+			state = newSignalBox(Configuration{}, nil)
+
+			config, _ := parseConfiguration("foo")
+			a = newConnection(config, nil)
+			b = newConnection(config, nil)
+			c = newConnection(config, nil)
+
+			for _, m := range []struct {
+				socket  *Connection
+				message string
+			}{{a, "/announce|a|{\"room\":\"test\"}"},
+				{a, "/announce|a|{\"room\":\"test2\"}"},
+				{b, "/announce|b|{\"room\":\"test\"}"},
+				{b, "/announce|b|{\"room\":\"test2\"}"},
+				{c, "/announce|c|{\"room\":\"test2\"}"}} {
+				action, message, _ := ParseMessage(m.message)
+				state, _ = action(message, m.socket, state)
+			}
+
+			for _, s := range []*Connection{a, b, c} {
+				for len(s.outbound) > 0 {
+					<-s.outbound
+				}
+			}
+		})
 
-			c2, err := connectPeer("c2", "to-test")
+		It("Should send to every room once, when no room is named", func() {
+			action, message, _ := ParseMessage("/hello|a")
+			_, err := action(message, a, state)
 			Ω(err).Should(BeNil())
-			socketShouldContain(c2, "/roominfo|{\"memberCount\":3}")
 
-			socketShouldContain(a2, "/announce|b2|{\"room\":\"to-test\"}")
-			socketShouldContain(a2, "/announce|c2|{\"room\":\"to-test\"}")
+			Ω(len(a.outbound)).Should(Equal(0))
+			Ω(len(b.outbound)).Should(Equal(1))
+			Ω(string(<-b.outbound)).Should(Equal("/hello|a"))
+			Ω(len(c.outbound)).Should(Equal(1))
+			Ω(string(<-c.outbound)).Should(Equal("/hello|a"))
+		})
 
-			socketShouldContain(b2, "/announce|c2|{\"room\":\"to-test\"}")
-			socketSend(a2, "/to|c2|/hello|{\"id\":\"a1\"}")
+		It("Should only send to the room named in the payload", func() {
+			action, message, _ := ParseMessage("/hello|a|{\"room\":\"test\"}|hi")
+			_, err := action(message, a, state)
+			Ω(err).Should(BeNil())
 
-			socketShouldContain(c2, "/to|c2|/hello|{\"id\":\"a1\"}")
+			Ω(len(b.outbound)).Should(Equal(1))
+			Ω(string(<-b.outbound)).Should(Equal("/hello|a|{\"room\":\"test\"}|hi"))
+			Ω(len(c.outbound)).Should(Equal(0))
+		})
 
-			_, _, err = b2.ReadMessage()
+		It("Should reject messages naming a room the sender isn't in", func() {
+			action, message, _ := ParseMessage("/hello|c|{\"room\":\"test\"}")
+			_, err := action(message, c, state)
 			Ω(err).ShouldNot(BeNil())
+
+			Ω(len(a.outbound)).Should(Equal(0))
+			Ω(len(b.outbound)).Should(Equal(0))
+			Ω(string(<-c.outbound)).Should(Equal("/error|{\"code\":\"not-in-room\",\"command\":\"/hello\",\"message\":\"Unable to send /hello, peer c isn't in room test\"}"))
 		})
+	})
 
-		It("Should be able to send custom messages to peers", func() {
-			a3, err := connectPeer("a3", "custom-test")
+	Context("Replies", func() {
+		var server *Server
+
+		BeforeEach(func() {
+			server, _ = NewServer(DefaultConfiguration())
+		})
+
+		AfterEach(func() {
+			shutdown(server)
+		})
+
+		It("Should parse the request id off the front of a message", func() {
+			action, message, err := ParseMessage("#7|/announce|a|{\"room\":\"test\"}")
 			Ω(err).Should(BeNil())
-			socketShouldContain(a3, "/roominfo|{\"memberCount\":1}")
+			Ω(runtime.FuncForPC(reflect.ValueOf(action).Pointer()).Name()).Should(Equal("github.com/cfreeman/signalbox.announce"))
+			Ω(message).Should(Equal(ParsedMessage{Command: "/announce", Peer: "a", Payload: "{\"room\":\"test\"}", RequestId: "7"}))
+			Ω(message.String()).Should(Equal("#7|/announce|a|{\"room\":\"test\"}"))
+			Ω(message.Parts()).Should(Equal([]string{"/announce", "a", "{\"room\":\"test\"}"}))
+		})
 
-			b3, err := connectPeer("b3", "custom-test")
+		It("Should acknowledge messages that carry a request id", func() {
+			a := server.Connect("127.0.0.1:0")
+			peerSend(a, "#1|/announce|a|{\"room\":\"test\"}")
+			peerShouldReceive(a, "/roominfo|{\"memberCount\":1,\"members\":[]}")
+			peerShouldReceive(a, "/ack|{\"id\":\"1\",\"command\":\"/announce\"}")
+
+			b, err := connectPeer(server, "b", "test")
 			Ω(err).Should(BeNil())
-			socketShouldContain(b3, "/roominfo|{\"memberCount\":2}")
+			peerShouldReceive(b, "/roominfo|{\"memberCount\":2,\"members\":[{\"id\":\"a\",\"data\":{\"room\":\"test\"}}]}")
+			peerShouldReceive(a, "/announce|b|{\"room\":\"test\"}")
 
-			socketShouldContain(a3, "/announce|b3|{\"room\":\"custom-test\"}")
-			socketSend(a3, "/hello|a3")
-			socketShouldContain(b3, "/hello|a3")
+			// The request id is only for the sender, it isn't relayed.
+			peerSend(a, "#2|/hello|a")
+			peerShouldReceive(b, "/hello|a")
+			peerShouldReceive(a, "/ack|{\"id\":\"2\",\"command\":\"/hello\"}")
 		})
 
-		It("Should get a leave message when a peer disconnects", func() {
-			a4, err := connectPeer("a4", "close-test")
+		It("Should only acknowledge messages that ask", func() {
+			a, err := connectPeer(server, "a", "test")
 			Ω(err).Should(BeNil())
-			socketShouldContain(a4, "/roominfo|{\"memberCount\":1}")
+			peerShouldReceive(a, "/roominfo|{\"memberCount\":1,\"members\":[]}")
+			Consistently(a.Messages(), "100ms").ShouldNot(Receive())
+		})
 
-			b4, err := connectPeer("b4", "close-test")
+		It("Should echo the request id in errors", func() {
+			a, err := connectPeer(server, "a", "test")
 			Ω(err).Should(BeNil())
-			socketShouldContain(b4, "/roominfo|{\"memberCount\":2}")
+			peerShouldReceive(a, "/roominfo|{\"memberCount\":1,\"members\":[]}")
 
-			socketShouldContain(a4, "/announce|b4|{\"room\":\"close-test\"}")
-			err = a4.Close()
+			peerSend(a, "#3|/leave|a|{\"room\":\"nowhere\"}")
+			peerShouldReceive(a, "/error|{\"id\":\"3\",\"code\":\"not-in-room\",\"command\":\"/leave\",\"message\":\"Unable to leave, room nowhere doesn't exist\"}")
+			Consistently(a.Messages(), "100ms").ShouldNot(Receive())
+		})
+
+		It("Should not acknowledge messages that were ignored", func() {
+			a, err := connectPeer(server, "a", "test")
 			Ω(err).Should(BeNil())
-			socketShouldContain(b4, "/leave|a4|{\"room\":\"close-test\"}")
+			peerShouldReceive(a, "/roominfo|{\"memberCount\":1,\"members\":[]}")
+
+			peerSend(a, "#4|garbage")
+			peerShouldReceive(a, "/error|{\"id\":\"4\",\"code\":\"invalid-message\",\"command\":\"garbage\",\"message\":\"Unable to handle garbage, it isn't a command\"}")
+
+			peerSend(a, "garbage")
+			Consistently(a.Messages(), "100ms").ShouldNot(Receive())
 		})
 
-		It("Should be able to handle very long messages", func() {
-			a5, err := connectPeer("a5", "long-test")
+		It("Should tell peers about messages to peers that don't exist", func() {
+			a, err := connectPeer(server, "a", "test")
 			Ω(err).Should(BeNil())
-			socketShouldContain(a5, "/roominfo|{\"memberCount\":1}")
+			peerShouldReceive(a, "/roominfo|{\"memberCount\":1,\"members\":[]}")
 
-			b5, err := connectPeer("b5", "long-test")
-			socketShouldContain(b5, "/roominfo|{\"memberCount\":2}")
+			peerSend(a, "/to|z|/hello|{\"id\":\"a\"}")
+			peerShouldReceive(a, "/error|{\"code\":\"unknown-peer\",\"command\":\"/to\",\"message\":\"Unable to send 'to' message, peer z isn't in any of your rooms\"}")
+		})
 
-			socketShouldContain(a5, "/announce|b5|{\"room\":\"long-test\"}")
+		It("Should tell peers about messages that can't be parsed", func() {
+			a := server.Connect("127.0.0.1:0")
+			peerSend(a, "/announce|a|not json")
 
-			socketSend(b5, "/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa|b5")
+			var message string
+			Eventually(a.Messages()).Should(Receive(&message))
+			Ω(message).Should(HavePrefix("/error|{\"code\":\"invalid-message\",\"command\":\"/announce\""))
 
-			socketShouldContain(a5, "/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa|b5")
+			peerSend(a, "/to")
+			peerShouldReceive(a, "/error|{\"code\":\"invalid-message\",\"command\":\"/to\",\"message\":\"Not enouth parts for personalised 'to' message\"}")
 		})
 	})
-})
 
-func socketSend(ws *websocket.Conn, content string) {
-	ws.WriteMessage(websocket.TextMessage, []byte(content))
-}
+	Context("Delivery receipts", func() {
+		var server *Server
+		var a, b *MemoryConn
 
-func socketShouldContain(ws *websocket.Conn, content string) {
-	_, message, err := ws.ReadMessage()
-	Ω(err).Should(BeNil())
-	Ω(string(message)).Should(Equal(content))
-}
+		BeforeEach(func() {
+			config := DefaultConfiguration()
+			config.ReconnectWindow = Duration(30 * time.Second)
+			server, _ = NewServer(config)
+
+			a = server.Connect("127.0.0.1:0")
+			peerSend(a, "/announce|a|{\"room\":\"test\",\"receipts\":true}")
+			var reply string
+			Eventually(a.Messages()).Should(Receive(&reply))
+			Ω(reply).Should(HavePrefix("/roominfo|"))
+
+			b = server.Connect("127.0.0.1:0")
+			peerSend(b, "/announce|b|{\"room\":\"test\"}")
+			Eventually(b.Messages()).Should(Receive(&reply))
+			Ω(reply).Should(HavePrefix("/roominfo|"))
+			peerShouldReceive(a, "/announce|b|{\"room\":\"test\"}")
+		})
 
-func connectPeer(id string, room string) (*websocket.Conn, error) {
-	url := "ws://localhost:3000"
-	res, _, err := websocket.DefaultDialer.Dial(url, nil)
-	if err != nil || res == nil {
-		return nil, err
-	}
+		AfterEach(func() {
+			shutdown(server)
+		})
 
-	connect := fmt.Sprintf("/announce|%s|{\"room\":\"%s\"}", id, room)
-	err = res.WriteMessage(websocket.TextMessage, []byte(connect))
-	if err != nil {
-		return nil, err
-	}
+		It("Should tell peers that asked when their message was delivered", func() {
+			peerSend(a, "#1|/to|b|/offer|{\"id\":\"a\"}")
+			peerShouldReceive(b, "/to|b|/offer|{\"id\":\"a\"}")
+			peerShouldReceive(a, "/receipt|{\"id\":\"1\",\"to\":\"b\",\"status\":\"delivered\"}")
+			peerShouldReceive(a, "/ack|{\"id\":\"1\",\"command\":\"/to\"}")
+		})
+
+		It("Should tell peers that asked when the recipient doesn't exist", func() {
+			peerSend(a, "/to|z|/offer|{\"id\":\"a\"}")
+			peerShouldReceive(a, "/receipt|{\"to\":\"z\",\"status\":\"unknown-peer\"}")
+			Consistently(a.Messages(), "100ms").ShouldNot(Receive())
+		})
+
+		It("Should tell peers that asked when the message is waiting for the recipient to resume", func() {
+			Ω(b.Close()).Should(BeNil())
+			Eventually(func() bool {
+				var held bool
+				inSignalBox(server.msg, func(state SignalBox) (SignalBox, adminReply) {
+					held = state.Peers["b"].disconnected
+					return state, adminReply{200, nil}
+				})
+				return held
+			}).Should(BeTrue())
+
+			peerSend(a, "/to|b|/offer|{\"id\":\"a\"}")
+			peerShouldReceive(a, "/receipt|{\"to\":\"b\",\"status\":\"queued\"}")
+		})
+
+		It("Should keep sending receipts until a later announce turns them off", func() {
+			var reply string
+			peerSend(a, "/announce|a|{\"room\":\"other\"}")
+			Eventually(a.Messages()).Should(Receive(&reply))
+			Ω(reply).Should(HavePrefix("/roominfo|"))
+
+			peerSend(a, "/to|b|/offer|{\"id\":\"a\"}")
+			peerShouldReceive(b, "/to|b|/offer|{\"id\":\"a\"}")
+			peerShouldReceive(a, "/receipt|{\"to\":\"b\",\"status\":\"delivered\"}")
+
+			peerSend(a, "/announce|a|{\"room\":\"test\",\"receipts\":false}")
+			Eventually(a.Messages()).Should(Receive(&reply))
+			Ω(reply).Should(HavePrefix("/roominfo|"))
+			peerShouldReceive(b, "/announce|a|{\"room\":\"test\",\"receipts\":false}")
+
+			peerSend(a, "/to|b|/offer|{\"id\":\"a\"}")
+			peerShouldReceive(b, "/to|b|/offer|{\"id\":\"a\"}")
+			Consistently(a.Messages(), "100ms").ShouldNot(Receive())
+		})
+
+		It("Should not send receipts to peers that didn't ask", func() {
+			peerSend(b, "/to|a|/answer|{\"id\":\"b\"}")
+			peerShouldReceive(a, "/to|a|/answer|{\"id\":\"b\"}")
+			Consistently(b.Messages(), "100ms").ShouldNot(Receive())
+		})
+
+		It("Should refuse 'to' messages from sockets whose peer has left every room", func() {
+			peerSend(a, "/leave|a|{\"room\":\"test\"}")
+			peerShouldReceive(b, "/leave|a|{\"room\":\"test\"}")
+
+			peerSend(a, "/to|b|/offer|{\"id\":\"a\"}")
+			peerShouldReceive(a, "/error|{\"code\":\"not-announced\",\"command\":\"/to\",\"message\":\"Unable to send 'to' message, peer a isn't in any rooms\"}")
+			Consistently(b.Messages(), "100ms").ShouldNot(Receive())
+		})
+
+		It("Should only let peers send to peers they share a room with", func() {
+			c, err := connectPeer(server, "c", "elsewhere")
+			Ω(err).Should(BeNil())
+			var reply string
+			Eventually(c.Messages()).Should(Receive(&reply))
+			Ω(reply).Should(HavePrefix("/roominfo|"))
+
+			peerSend(c, "/to|a|/offer|{\"id\":\"c\"}")
+			peerShouldReceive(c, "/error|{\"code\":\"unknown-peer\",\"command\":\"/to\",\"message\":\"Unable to send 'to' message, peer a isn't in any of your rooms\"}")
+
+			peerSend(a, "/to|c|/offer|{\"id\":\"a\"}")
+			peerShouldReceive(a, "/receipt|{\"to\":\"c\",\"status\":\"unknown-peer\"}")
+			Consistently(c.Messages(), "100ms").ShouldNot(Receive())
+		})
+	})
+
+	Context("Multicast messages", func() {
+		var server *Server
+		var a, b, c, d *MemoryConn
+
+		// join announces a new peer, and waits for everyone already in the room to hear about it.
+		join := func(id string, announce string, others ...*MemoryConn) *MemoryConn {
+			conn := server.Connect("127.0.0.1:0")
+			peerSend(conn, "/announce|"+id+"|"+announce)
+
+			var reply string
+			Eventually(conn.Messages()).Should(Receive(&reply))
+			Ω(reply).Should(HavePrefix("/roominfo|"))
+			for _, o := range others {
+				peerShouldReceive(o, "/announce|"+id+"|"+announce)
+			}
+
+			return conn
+		}
+
+		BeforeEach(func() {
+			server, _ = NewServer(DefaultConfiguration())
+
+			a = join("a", "{\"room\":\"talk\",\"role\":\"presenter\"}")
+			b = join("b", "{\"room\":\"talk\",\"role\":\"presenter\"}", a)
+			c = join("c", "{\"room\":\"talk\",\"role\":\"viewer\"}", a, b)
+			d = join("d", "{\"room\":\"other\",\"role\":\"presenter\"}")
+		})
+
+		AfterEach(func() {
+			shutdown(server)
+		})
+
+		It("Should send to a list of peers", func() {
+			peerSend(a, "/to|[\"b\",\"c\",\"b\"]|/hello|{\"id\":\"a\"}")
+			peerShouldReceive(b, "/to|b|/hello|{\"id\":\"a\"}")
+			peerShouldReceive(c, "/to|c|/hello|{\"id\":\"a\"}")
+			Consistently(b.Messages(), "100ms").ShouldNot(Receive())
+			Consistently(a.Messages(), "100ms").ShouldNot(Receive())
+		})
+
+		It("Should send to the peers matching a selector", func() {
+			peerSend(a, "/to|{\"room\":\"talk\",\"role\":\"presenter\"}|/hello|{\"id\":\"a\"}")
+			peerShouldReceive(b, "/to|b|/hello|{\"id\":\"a\"}")
+			Consistently(a.Messages(), "100ms").ShouldNot(Receive())
+			Consistently(c.Messages(), "100ms").ShouldNot(Receive())
+			Consistently(d.Messages(), "100ms").ShouldNot(Receive())
+		})
+
+		It("Should report the listed peers that aren't in a shared room", func() {
+			peerSend(a, "/to|[\"d\",\"b\"]|/hello|{\"id\":\"a\"}")
+			peerShouldReceive(b, "/to|b|/hello|{\"id\":\"a\"}")
+			peerShouldReceive(a, "/error|{\"code\":\"unknown-peer\",\"command\":\"/to\",\"message\":\"Unable to send 'to' message, peer d isn't in any of your rooms\"}")
+			Consistently(d.Messages(), "100ms").ShouldNot(Receive())
+		})
+
+		It("Should refuse selectors naming a room the sender isn't in", func() {
+			peerSend(a, "/to|{\"room\":\"other\"}|/hello|{\"id\":\"a\"}")
+			peerShouldReceive(a, "/error|{\"code\":\"not-in-room\",\"command\":\"/to\",\"message\":\"Unable to send 'to' message, peer a isn't in room other\"}")
+			Consistently(d.Messages(), "100ms").ShouldNot(Receive())
+		})
+
+		It("Should refuse selectors from sockets whose peer has left every room", func() {
+			peerSend(a, "/leave|a|{\"room\":\"talk\"}")
+			peerShouldReceive(b, "/leave|a|{\"room\":\"talk\"}")
+			peerShouldReceive(c, "/leave|a|{\"room\":\"talk\"}")
+
+			peerSend(a, "/to|{\"room\":\"other\"}|/hello|{\"id\":\"a\"}")
+			var reply string
+			Eventually(a.Messages()).Should(Receive(&reply))
+			Ω(reply).Should(HavePrefix("/error|{\"code\":\"not-announced\",\"command\":\"/to\""))
+			Consistently(d.Messages(), "100ms").ShouldNot(Receive())
+
+			// Signalbox raised messages (without a socket) can't select either.
+			_, err := selectRecipients(map[string]interface{}{"room": "other"}, nil, newSignalBox(DefaultConfiguration(), nil))
+			Ω(err).ShouldNot(BeNil())
+		})
+
+		It("Should refuse targets that can't be parsed", func() {
+			peerSend(a, "/to|[\"b\"|/hello|{\"id\":\"a\"}")
+
+			var reply string
+			Eventually(a.Messages()).Should(Receive(&reply))
+			Ω(reply).Should(HavePrefix("/error|{\"code\":\"invalid-message\",\"command\":\"/to\""))
+		})
+	})
+
+	Context("Capacity limits", func() {
+		var state SignalBox
+		var a, b, c *Connection
+
+		announceAs := func(id string, room string, socket *Connection) error {
+			action, message, _ := ParseMessage("/announce|" + id + "|{\"room\":\"" + room + "\"}")
+			var err error
+			state, err = action(message, socket, state)
+
+			return err
+		}
+
+		BeforeEach(func() {
+			state = newSignalBox(Configuration{MaxPeersPerRoom: 2,
+				RoomLimits:      []RoomLimit{RoomLimit{"lecture-*", 0}, RoomLimit{"pair", 1}},
+				MaxRoomsPerPeer: 2}, nil)
+
+			config, _ := parseConfiguration("foo")
+			a = newConnection(config, nil)
+			b = newConnection(config, nil)
+			c = newConnection(config, nil)
+		})
+
+		It("Should refuse entry to a full room", func() {
+			Ω(announceAs("a", "test", a)).Should(BeNil())
+			Ω(announceAs("b", "test", b)).Should(BeNil())
+			Ω(announceAs("c", "test", c)).ShouldNot(BeNil())
+			Ω(len(state.RoomContains["test"])).Should(Equal(2))
+			Ω(string(<-c.outbound)).Should(Equal("/error|{\"code\":\"room-full\",\"command\":\"/announce\",\"message\":\"Unable to announce, room test is full\"}"))
+
+			// Members of a full room can still announce into it again.
+			Ω(announceAs("a", "test", a)).Should(BeNil())
+		})
+
+		It("Should apply per room overrides", func() {
+			Ω(announceAs("a", "pair", a)).Should(BeNil())
+			Ω(announceAs("b", "pair", b)).ShouldNot(BeNil())
+
+			Ω(announceAs("a", "lecture-1", a)).Should(BeNil())
+			Ω(announceAs("b", "lecture-1", b)).Should(BeNil())
+			Ω(announceAs("c", "lecture-1", c)).Should(BeNil())
+		})
+
+		It("Should limit the number of rooms a peer is in", func() {
+			Ω(announceAs("a", "one", a)).Should(BeNil())
+			Ω(announceAs("a", "two", a)).Should(BeNil())
+			Ω(announceAs("a", "three", a)).ShouldNot(BeNil())
+			Ω(len(state.PeerIsIn["a"])).Should(Equal(2))
+		})
+
+		It("Should cap connections in total and from each address", func() {
+			counter := newConnectionCounter(Configuration{MaxConnections: 3, MaxConnectionsPerAddress: 2})
+
+			Ω(counter.open("1.2.3.4")).Should(BeNil())
+			Ω(counter.open("1.2.3.4")).Should(BeNil())
+			Ω(counter.open("1.2.3.4")).ShouldNot(BeNil())
+			Ω(counter.open("5.6.7.8")).Should(BeNil())
+			Ω(counter.open("9.9.9.9")).ShouldNot(BeNil())
+
+			counter.close("1.2.3.4")
+			Ω(counter.open("9.9.9.9")).Should(BeNil())
+			Ω(counter.open("1.2.3.4")).ShouldNot(BeNil())
+		})
+	})
+
+	Context("Resuming dropped connections", func() {
+		var state SignalBox
+		var a, b, a2 *Connection
+		var token string
+
+		BeforeEach(func() {
+			config, _ := parseConfiguration("foo")
+			config.ReconnectWindow = Duration(30 * time.Second)
+			state = newSignalBox(config, nil)
+
+			a = newConnection(config, nil)
+			b = newConnection(config, nil)
+			a2 = newConnection(config, nil)
+
+			action, message, _ := ParseMessage("/announce|a|{\"room\":\"test\"}")
+			state, _ = action(message, a, state)
+			action, message, _ = ParseMessage("/announce|b|{\"room\":\"test\"}")
+			state, _ = action(message, b, state)
+
+			var info RoomInfo
+			Ω(json.Unmarshal([]byte(strings.TrimPrefix(string(<-a.outbound), "/roominfo|")), &info)).Should(BeNil())
+			Ω(info.ResumeToken).ShouldNot(Equal(""))
+			token = info.ResumeToken
+
+			<-a.outbound
+			<-b.outbound
+
+			action, message, _ = ParseMessage("/close")
+			state, _ = action(message, a, state)
+		})
+
+		It("Should hold onto a peer that has dropped its connection", func() {
+			Ω(len(b.outbound)).Should(Equal(0))
+			Ω(len(state.RoomContains["test"])).Should(Equal(2))
+			Ω(state.Peers["a"].disconnected).Should(BeTrue())
+			Ω(a.isClosed()).Should(BeTrue())
+		})
+
+		It("Should let a new socket resume a held peer and deliver what it missed", func() {
+			action, message, _ := ParseMessage("/to|a|/hello|{\"id\":\"b\"}")
+			state, _ = action(message, b, state)
+
+			action, message, _ = ParseMessage("/resume|a|{\"token\":\"" + token + "\"}")
+			state, err := action(message, a2, state)
+			Ω(err).Should(BeNil())
+			Ω(state.Peers["a"].socket).Should(Equal(a2))
+			Ω(state.Peers["a"].disconnected).Should(BeFalse())
+			Ω(a2.id).Should(Equal("a"))
+
+			var resumed Resumed
+			Ω(json.Unmarshal([]byte(strings.TrimPrefix(string(<-a2.outbound), "/resumed|")), &resumed)).Should(BeNil())
+			Ω(resumed.Token).ShouldNot(Equal(token))
+			Ω(resumed.Rooms["test"].MemberCount).Should(Equal(2))
+			Ω(resumed.Rooms["test"].Members[0].Id).Should(Equal("b"))
+
+			Ω(string(<-a2.outbound)).Should(Equal("/to|a|/hello|{\"id\":\"b\"}"))
+			Ω(len(b.outbound)).Should(Equal(0))
+		})
+
+		It("Should refuse to resume with the wrong token", func() {
+			action, message, _ := ParseMessage("/resume|a|{\"token\":\"nope\"}")
+			state, err := action(message, a2, state)
+			Ω(err).ShouldNot(BeNil())
+			Ω(state.Peers["a"].disconnected).Should(BeTrue())
+			Ω(a2.id).Should(Equal(""))
+		})
+
+		It("Should refuse to let another socket announce as a held peer", func() {
+			action, message, _ := ParseMessage("/announce|a|{\"room\":\"test\"}")
+			state, err := action(message, a2, state)
+			Ω(err).ShouldNot(BeNil())
+			Ω(state.Peers["a"].disconnected).Should(BeTrue())
+		})
+
+		It("Should tell the room that a held peer has left once the window expires", func() {
+			_, message, _ := ParseMessage("/expire|a|" + token)
+			state, err := expire(message, nil, state)
+			Ω(err).Should(BeNil())
+			Ω(len(state.RoomContains["test"])).Should(Equal(1))
+			Ω(state.Peers["a"]).Should(BeNil())
+			Ω(string(<-b.outbound)).Should(Equal("/leave|a|{\"room\":\"test\"}"))
+		})
+
+		It("Should ignore the expiry of a peer that has since resumed", func() {
+			action, message, _ := ParseMessage("/resume|a|{\"token\":\"" + token + "\"}")
+			state, _ = action(message, a2, state)
+
+			_, message, _ = ParseMessage("/expire|a|" + token)
+			state, err := expire(message, nil, state)
+			Ω(err).Should(BeNil())
+			Ω(len(state.RoomContains["test"])).Should(Equal(2))
+			Ω(len(b.outbound)).Should(Equal(0))
+		})
+	})
+
+	Context("Admin API", func() {
+		var handler http.Handler
+		var msg *mailbox
+		var drainer *Drainer
+		var a, b *Connection
+
+		admin := func(method string, path string, token string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest(method, path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			return res
+		}
+
+		BeforeEach(func() {
+			config, _ := parseConfiguration("foo")
+			config.AdminToken = "secret"
+
+			msg = newMailbox()
+			go signalbox(newSignalBox(config, msg))
+			drainer = newDrainer(config, msg, defaultLogger)
+			handler = adminHandler(config, msg, drainer, defaultLogger)
+
+			a = newConnection(config, nil)
+			b = newConnection(config, nil)
+			msg.send(Message{a, "/announce|a|{\"room\":\"test\"}", nil})
+			msg.send(Message{b, "/announce|b|{\"room\":\"test\"}", nil})
+			msg.send(Message{b, "/announce|b|{\"room\":\"test2\"}", nil})
+		})
+
+		AfterEach(func() {
+			msg.stop()
+		})
+
+		It("Should refuse requests without the admin token", func() {
+			res := admin("GET", "/rooms", "wrong")
+			Ω(res.Code).Should(Equal(401))
+		})
+
+		It("Should list rooms with their members", func() {
+			res := admin("GET", "/rooms", "secret")
+			Ω(res.Code).Should(Equal(200))
+
+			var rooms []RoomStatus
+			Ω(json.Unmarshal(res.Body.Bytes(), &rooms)).Should(BeNil())
+			Ω(rooms).Should(Equal([]RoomStatus{{"test", false, []string{"a", "b"}},
+				{"test2", false, []string{"b"}}}))
+		})
+
+		It("Should show the rooms a peer is in", func() {
+			res := admin("GET", "/peers/b", "secret")
+			Ω(res.Code).Should(Equal(200))
+
+			var peer PeerStatus
+			Ω(json.Unmarshal(res.Body.Bytes(), &peer)).Should(BeNil())
+			Ω(peer.Rooms).Should(Equal([]string{"test", "test2"}))
+
+			res = admin("GET", "/peers/nobody", "secret")
+			Ω(res.Code).Should(Equal(404))
+		})
+
+		It("Should be able to kick a peer", func() {
+			res := admin("DELETE", "/peers/a", "secret")
+			Ω(res.Code).Should(Equal(204))
+			Ω(a.isClosed()).Should(BeTrue())
+
+			res = admin("GET", "/rooms/test", "secret")
+			var room RoomStatus
+			Ω(json.Unmarshal(res.Body.Bytes(), &room)).Should(BeNil())
+			Ω(room.Members).Should(Equal([]string{"b"}))
+		})
+
+		It("Should be able to close a room", func() {
+			res := admin("DELETE", "/rooms/test", "secret")
+			Ω(res.Code).Should(Equal(204))
+
+			res = admin("GET", "/rooms/test", "secret")
+			Ω(res.Code).Should(Equal(404))
+
+			res = admin("GET", "/peers/a", "secret")
+			Ω(res.Code).Should(Equal(404))
+
+			// Every member is told that they left, not just about the others.
+			received := func(c *Connection) []string {
+				var messages []string
+				for len(c.outbound) > 0 {
+					messages = append(messages, string(<-c.outbound))
+				}
+				return messages
+			}
+			Ω(received(a)).Should(ContainElement("/leave|a|{\"room\":\"test\"}"))
+			Ω(received(b)).Should(ContainElement("/leave|b|{\"room\":\"test\"}"))
+		})
+
+		It("Should be able to start and stop draining", func() {
+			res := admin("POST", "/drain", "secret")
+			Ω(res.Code).Should(Equal(202))
+			Ω(drainer.isDraining()).Should(BeTrue())
+
+			res = admin("POST", "/drain", "secret")
+			Ω(res.Code).Should(Equal(409))
+
+			res = admin("GET", "/drain", "secret")
+			var status DrainStatus
+			Ω(json.Unmarshal(res.Body.Bytes(), &status)).Should(BeNil())
+			Ω(status.Draining).Should(BeTrue())
+
+			res = admin("DELETE", "/drain", "secret")
+			Ω(res.Code).Should(Equal(204))
+			Ω(drainer.isDraining()).Should(BeFalse())
+		})
+	})
+
+	Context("Draining", func() {
+		var msg *mailbox
+		var drainer *Drainer
+		var a, b *Connection
+
+		BeforeEach(func() {
+			config, _ := parseConfiguration("foo")
+			config.DrainTimeout = 0
+			config.DrainReconnectHint = true
+			config.DrainReconnectURL = "wss://other.example.com"
+			config.DrainReconnectJitter = Duration(time.Second)
+
+			msg = newMailbox()
+			go signalbox(newSignalBox(config, msg))
+			drainer = newDrainer(config, msg, defaultLogger)
+
+			a = newConnection(config, nil)
+			b = newConnection(config, nil)
+			Ω(drainer.add(a)).Should(BeTrue())
+			Ω(drainer.add(b)).Should(BeTrue())
+			msg.send(Message{a, "/announce|a|{\"room\":\"test\"}", nil})
+			<-a.outbound
+
+			// Stand in for the writer goroutines, which stop tracking connections once closed.
+			for _, c := range []*Connection{a, b} {
+				go func(c *Connection) {
+					<-c.closed
+					drainer.remove(c)
+				}(c)
+			}
+		})
+
+		AfterEach(func() {
+			msg.stop()
+		})
+
+		It("Should refuse new connections while draining", func() {
+			Ω(drainer.start()).Should(BeTrue())
+			Ω(drainer.start()).Should(BeFalse())
+			Ω(drainer.add(newConnection(Configuration{}, nil))).Should(BeFalse())
+
+			drainer.stop()
+			Ω(drainer.add(newConnection(Configuration{}, nil))).Should(BeTrue())
+		})
+
+		It("Should hint peers to reconnect, then close every connection", func() {
+			drainer.start()
+			drainer.drain(context.Background())
+
+			parts := strings.Split(string(<-a.outbound), "|")
+			Ω(parts[0]).Should(Equal("/reconnect"))
+
+			var r Reconnect
+			Ω(json.Unmarshal([]byte(parts[1]), &r)).Should(BeNil())
+			Ω(r.URL).Should(Equal("wss://other.example.com"))
+			Ω(r.Delay).Should(BeNumerically("<", 1000))
+
+			for _, c := range []*Connection{a, b} {
+				Ω(c.isClosed()).Should(BeTrue())
+				Ω(c.closeCode).Should(Equal(CloseGoingAway))
+			}
+			Ω(drainer.open()).Should(Equal(0))
+		})
+	})
+
+	Context("Metrics", func() {
+		It("Should label messages by the command they dispatch", func() {
+			for _, c := range []struct{ message, name string }{{"/announce|a", "announce"},
+				{"/to|a", "to"},
+				{"/hello|a", "custom"},
+				{"hello", "ignored"},
+				{"", "ignored"}} {
+				_, message, _ := ParseMessage(c.message)
+				Ω(commandName(message)).Should(Equal(c.name))
+			}
+		})
+
+		It("Should expose metrics in the prometheus text format", func() {
+			m := newMetrics()
+			m.socketOpened()
+			m.received(10)
+			m.sent(20)
+			m.writeFailed()
+
+			state := newSignalBox(Configuration{}, nil)
+			state, _ = announce(ParsedMessage{Command: "/announce", Peer: "a", Payload: "{\"room\":\"test\"}"}, nil, state)
+			m.handled("announce", 200*time.Microsecond, state)
+			m.handled("announce", 2*time.Millisecond, state)
+
+			res := httptest.NewRecorder()
+			m.ServeHTTP(res, nil)
+			body := res.Body.String()
+
+			Ω(body).Should(ContainSubstring("# TYPE signalbox_sockets gauge\nsignalbox_sockets 1\n"))
+			Ω(body).Should(ContainSubstring("signalbox_peers 1\n"))
+			Ω(body).Should(ContainSubstring("signalbox_rooms 1\n"))
+			Ω(body).Should(ContainSubstring("signalbox_messages_total{command=\"announce\"} 2\n"))
+			Ω(body).Should(ContainSubstring("signalbox_received_bytes_total 10\n"))
+			Ω(body).Should(ContainSubstring("signalbox_sent_bytes_total 20\n"))
+			Ω(body).Should(ContainSubstring("signalbox_write_failures_total 1\n"))
+			Ω(body).Should(ContainSubstring("signalbox_message_duration_seconds_bucket{le=\"0.0005\"} 1\n"))
+			Ω(body).Should(ContainSubstring("signalbox_message_duration_seconds_bucket{le=\"0.005\"} 2\n"))
+			Ω(body).Should(ContainSubstring("signalbox_message_duration_seconds_bucket{le=\"+Inf\"} 2\n"))
+			Ω(body).Should(ContainSubstring("signalbox_message_duration_seconds_count 2\n"))
+		})
+	})
+
+	Context("Logging", func() {
+		var out bytes.Buffer
+		var config Configuration
+
+		BeforeEach(func() {
+			out.Reset()
+			config, _ = parseConfiguration("foo")
+		})
+
+		It("Should discard messages below the configured level", func() {
+			config.LogLevel = "warn"
+			l := newLogger(config, &out)
+			l.Info("Adding peer", "peer", "a")
+			Ω(out.String()).Should(Equal(""))
+
+			l.Error("Unable to update state", "err", errors.New("oops"))
+			Ω(out.String()).Should(ContainSubstring(" level=ERROR msg=\"Unable to update state\" err=oops\n"))
+		})
+
+		It("Should be able to write each line as JSON", func() {
+			config.LogFormat = "json"
+			l := newLogger(config, &out)
+			l.Info("Adding peer", "peer", "a")
+
+			var line map[string]interface{}
+			Ω(json.Unmarshal(out.Bytes(), &line)).Should(BeNil())
+			Ω(line["level"]).Should(Equal("INFO"))
+			Ω(line["msg"]).Should(Equal("Adding peer"))
+			Ω(line["peer"]).Should(Equal("a"))
+		})
+
+		It("Should not log payloads by default", func() {
+			config.LogLevel = "debug"
+			l := newLogger(config, &out)
+			l.Payload("Received message", "/to|b|/offer|{\"sdp\":\"v=0\"}")
+			Ω(out.String()).ShouldNot(ContainSubstring("/offer"))
+			Ω(out.String()).Should(ContainSubstring("bytes=26"))
+		})
+
+		It("Should strip SDP and candidate addresses from redacted payloads", func() {
+			config.LogLevel = "debug"
+			config.LogPayloads = PayloadsRedacted
+			l := newLogger(config, &out)
+			l.Payload("Received message", "/to|b|/candidate|{\"candidate\":\"candidate:1 1 udp 2122260223 192.168.1.2 54321 typ host\",\"sdpMid\":\"0\"}|{\"id\":\"a\"}")
+
+			Ω(out.String()).ShouldNot(ContainSubstring("192.168.1.2"))
+			Ω(redact("/to|b|/offer|{\"sdp\":\"v=0\\r\\no=- 1 2 IN IP4 10.0.0.1\"}|{\"id\":\"a\"}")).Should(Equal("/to|b|/offer|{\"sdp\":\"[redacted]\"}|{\"id\":\"a\"}"))
+			Ω(redact(`#1|/to|b|/offer|{"id":"a"}|{"sdp":"v=0\r\nc=IN IP4 10.0.0.1","note":"x|y"}`)).Should(Equal(`#1|/to|b|/offer|{"id":"a"}|{"note":"x|y","sdp":"[redacted]"}`))
+			Ω(redact(`/to|b|/offer|{"sdp":"c=IN IP4 10.0.0.1|x"`)).Should(Equal(`/to|b|/offer|[redacted]|[redacted]`))
+		})
+
+		It("Should strip tokens from redacted announces", func() {
+			config.LogLevel = "debug"
+			config.LogPayloads = PayloadsRedacted
+			l := newLogger(config, &out)
+			l.Payload("Received message", `/announce|a|{"room":"x","token":"eyJhbGciOi.secret.sig"}`)
+
+			Ω(out.String()).ShouldNot(ContainSubstring("secret"))
+			Ω(redact(`/announce|a|{"room":"x","token":"eyJhbGciOi.secret.sig"}`)).Should(Equal(`/announce|a|{"room":"x","token":"[redacted]"}`))
+		})
+
+		It("Should strip resume tokens from redacted payloads", func() {
+			Ω(redact(`/resume|a|{"token":"abc123"}`)).Should(Equal(`/resume|a|{"token":"[redacted]"}`))
+			Ω(redact(`/roominfo|{"memberCount":1,"members":[],"resumeToken":"abc123"}`)).Should(Equal(`/roominfo|{"memberCount":1,"members":[],"resumeToken":"[redacted]"}`))
+			Ω(redact(`/resumed|{"rooms":{},"token":"abc123"}`)).Should(Equal(`/resumed|{"rooms":{},"token":"[redacted]"}`))
+		})
+	})
+
+	Context("TLS certificates", func() {
+		var dir, certFile, keyFile string
+
+		commonName := func(r *CertificateReloader) string {
+			cert, err := r.GetCertificate(nil)
+			Ω(err).Should(BeNil())
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			Ω(err).Should(BeNil())
+
+			return leaf.Subject.CommonName
+		}
+
+		BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "signalbox")
+			certFile = filepath.Join(dir, "cert.pem")
+			keyFile = filepath.Join(dir, "key.pem")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("Should return an error when the certificate can't be loaded", func() {
+			_, err := newCertificateReloader(certFile, keyFile, defaultLogger)
+			Ω(err).ShouldNot(BeNil())
+		})
+
+		It("Should pick up a renewed certificate", func() {
+			writeCertificate("first", certFile, keyFile)
+			r, err := newCertificateReloader(certFile, keyFile, defaultLogger)
+			Ω(err).Should(BeNil())
+			Ω(commonName(r)).Should(Equal("first"))
+			Ω(r.changed()).Should(BeFalse())
+
+			writeCertificate("second", certFile, keyFile)
+			later := time.Now().Add(time.Hour)
+			os.Chtimes(certFile, later, later)
+			Ω(r.changed()).Should(BeTrue())
+			Ω(r.reload()).Should(BeNil())
+			Ω(commonName(r)).Should(Equal("second"))
+		})
+
+		It("Should keep the old certificate if the new one is broken", func() {
+			writeCertificate("first", certFile, keyFile)
+			r, err := newCertificateReloader(certFile, keyFile, defaultLogger)
+			Ω(err).Should(BeNil())
+
+			ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+			Ω(r.reload()).ShouldNot(BeNil())
+			Ω(commonName(r)).Should(Equal("first"))
+		})
+	})
+
+	Context("Origins", func() {
+		allowed := []string{"https://example.com", "https://*.example.org", "*.example.net"}
+
+		It("Should allow every origin when no origins are configured", func() {
+			Ω(originAllowed(nil, "https://evil.com")).Should(BeTrue())
+		})
+
+		It("Should allow requests that don't come from a browser", func() {
+			Ω(originAllowed(allowed, "")).Should(BeTrue())
+		})
+
+		It("Should match origins exactly", func() {
+			Ω(originAllowed(allowed, "https://example.com")).Should(BeTrue())
+			Ω(originAllowed(allowed, "https://EXAMPLE.com")).Should(BeTrue())
+			Ω(originAllowed(allowed, "http://example.com")).Should(BeFalse())
+			Ω(originAllowed(allowed, "https://example.com:8443")).Should(BeFalse())
+			Ω(originAllowed(allowed, "https://www.example.com")).Should(BeFalse())
+			Ω(originAllowed(allowed, "https://evil.com")).Should(BeFalse())
+		})
+
+		It("Should match wildcard subdomains", func() {
+			Ω(originAllowed(allowed, "https://meet.example.org")).Should(BeTrue())
+			Ω(originAllowed(allowed, "https://a.b.example.org")).Should(BeTrue())
+			Ω(originAllowed(allowed, "https://example.org")).Should(BeFalse())
+			Ω(originAllowed(allowed, "https://evilexample.org")).Should(BeFalse())
+			Ω(originAllowed(allowed, "http://meet.example.org")).Should(BeFalse())
+			Ω(originAllowed(allowed, "http://meet.example.net")).Should(BeTrue())
+		})
+	})
+
+	Context("Authentication", func() {
+		var dir string
+		var c *Connection
+
+		announceAs := func(auth Authenticator, id string, announce string) (ParsedMessage, error) {
+			return authenticateAnnounce(auth, c, ParsedMessage{Command: "/announce", Peer: id, Payload: announce})
+		}
+
+		BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "signalbox")
+			c = newConnection(Configuration{}, nil)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("Should not authenticate when nothing is configured", func() {
+			auth, err := newAuthenticator(Configuration{}, defaultLogger)
+			Ω(err).Should(BeNil())
+			Ω(auth).Should(BeNil())
+		})
+
+		It("Should restrict static tokens to their rooms and peers", func() {
+			tokenFile := filepath.Join(dir, "tokens.json")
+			ioutil.WriteFile(tokenFile, []byte(`{"abc":{"rooms":["team-*"],"peers":["a"]},"def":{}}`), 0600)
+			auth, err := newAuthenticator(Configuration{AuthTokenFile: tokenFile}, defaultLogger)
+			Ω(err).Should(BeNil())
+
+			_, err = announceAs(auth, "a", `{"id":"a","room":"team-1","token":"abc"}`)
+			Ω(err).Should(BeNil())
+			_, err = announceAs(auth, "a", `{"id":"a","room":"other","token":"abc"}`)
+			Ω(err).ShouldNot(BeNil())
+			_, err = announceAs(auth, "b", `{"id":"b","room":"team-1","token":"abc"}`)
+			Ω(err).ShouldNot(BeNil())
+			_, err = announceAs(auth, "b", `{"id":"b","room":"other","token":"def"}`)
+			Ω(err).Should(BeNil())
+			_, err = announceAs(auth, "b", `{"id":"b","room":"other","token":"xyz"}`)
+			Ω(err).ShouldNot(BeNil())
+			_, err = announceAs(auth, "b", `{"id":"b","room":"other"}`)
+			Ω(err).ShouldNot(BeNil())
+		})
+
+		It("Should leave the peers of shared claims alone when checking the subject", func() {
+			claims := Claims{Peers: make([]string, 1, 2), Subject: "a"}
+			claims.Peers[0] = "b"
+
+			Ω(claims.permit(&AuthRequest{Peer: "a", Room: "r"})).Should(BeNil())
+			Ω(claims.Peers[:2][1]).Should(Equal(""))
+		})
+
+		It("Should strip the token before the announce is forwarded", func() {
+			auth := &TokenFileAuthenticator{map[string]Claims{"abc": Claims{}}}
+
+			m, err := announceAs(auth, "a", `{"id":"a","room":"b","token":"abc"}`)
+			Ω(err).Should(BeNil())
+			Ω(m).Should(Equal(ParsedMessage{Command: "/announce", Peer: "a", Payload: `{"id":"a","room":"b"}`}))
+		})
+
+		It("Should leave the rest of the announce as it was written when stripping the token", func() {
+			auth := &TokenFileAuthenticator{map[string]Claims{"abc": Claims{}}}
+
+			m, err := announceAs(auth, "a", `{"room":"b","token":"abc","uid":12345678901234567890,"id":"a"}`)
+			Ω(err).Should(BeNil())
+			Ω(m.Payload).Should(Equal(`{"room":"b","uid":12345678901234567890,"id":"a"}`))
+
+			m, err = announceAs(auth, "a", `{ "token" : "abc" , "room":"b"}`)
+			Ω(err).Should(BeNil())
+			Ω(m.Payload).Should(Equal(`{  "room":"b"}`))
+
+			m, err = announceAs(auth, "a", `{"token":"xyz","token":"abc","room":"b"}`)
+			Ω(err).Should(BeNil())
+			Ω(m.Payload).Should(Equal(`{"room":"b"}`))
+		})
+
+		It("Should accept a token from the query string", func() {
+			auth := &TokenFileAuthenticator{map[string]Claims{"abc": Claims{}}}
+			c.query = map[string][]string{"token": []string{"abc"}}
+
+			m, err := announceAs(auth, "a", `{"id":"a","room":"b"}`)
+			Ω(err).Should(BeNil())
+			Ω(m).Should(Equal(ParsedMessage{Command: "/announce", Peer: "a", Payload: `{"id":"a","room":"b"}`}))
+		})
+
+		It("Should verify HMAC signed JWTs", func() {
+			secretFile := filepath.Join(dir, "secret")
+			ioutil.WriteFile(secretFile, []byte("sekrit\n"), 0600)
+			auth, err := newAuthenticator(Configuration{AuthJWTSecretFile: secretFile}, defaultLogger)
+			Ω(err).Should(BeNil())
+
+			token := signHS256([]byte("sekrit"), `{"rooms":["b"],"sub":"a"}`)
+			_, err = announceAs(auth, "a", `{"id":"a","room":"b","token":"`+token+`"}`)
+			Ω(err).Should(BeNil())
+			_, err = announceAs(auth, "a", `{"id":"a","room":"c","token":"`+token+`"}`)
+			Ω(err).ShouldNot(BeNil())
+			_, err = announceAs(auth, "z", `{"id":"z","room":"b","token":"`+token+`"}`)
+			Ω(err).ShouldNot(BeNil())
+
+			forged := signHS256([]byte("guess"), `{"rooms":["b"],"sub":"a"}`)
+			_, err = announceAs(auth, "a", `{"id":"a","room":"b","token":"`+forged+`"}`)
+			Ω(err).ShouldNot(BeNil())
+
+			expired := signHS256([]byte("sekrit"), fmt.Sprintf(`{"exp":%d}`, time.Now().Unix()-1))
+			_, err = announceAs(auth, "a", `{"id":"a","room":"b","token":"`+expired+`"}`)
+			Ω(err).ShouldNot(BeNil())
+		})
+
+		It("Should verify JWTs signed with a private key", func() {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Ω(err).Should(BeNil())
+			der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			Ω(err).Should(BeNil())
+
+			publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+			publicKeyFile := filepath.Join(dir, "public.pem")
+			ioutil.WriteFile(publicKeyFile, publicKey, 0600)
+			auth, err := newAuthenticator(Configuration{AuthJWTPublicKeyFile: publicKeyFile}, defaultLogger)
+			Ω(err).Should(BeNil())
+
+			token := signES256(key, `{"rooms":["b"]}`)
+			_, err = announceAs(auth, "a", `{"id":"a","room":"b","token":"`+token+`"}`)
+			Ω(err).Should(BeNil())
+			_, err = announceAs(auth, "a", `{"id":"a","room":"c","token":"`+token+`"}`)
+			Ω(err).ShouldNot(BeNil())
+
+			// The public key must never be usable as an HMAC secret.
+			confused := signHS256(publicKey, `{}`)
+			_, err = announceAs(auth, "a", `{"id":"a","room":"b","token":"`+confused+`"}`)
+			Ω(err).ShouldNot(BeNil())
+		})
+	})
+
+	Context("Authorization webhook", func() {
+		var server *httptest.Server
+		var lock sync.Mutex // Guards calls, received and reply, which the webhook handler shares with each spec.
+		var calls int
+		var received WebhookRequest
+		var reply string
+
+		respond := func(r string) {
+			lock.Lock()
+			defer lock.Unlock()
+			reply = r
+		}
+
+		called := func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return calls
+		}
+
+		lastRequest := func() WebhookRequest {
+			lock.Lock()
+			defer lock.Unlock()
+			return received
+		}
+
+		authenticate := func(config Configuration, announce string) (*AuthRequest, error) {
+			config.AuthWebhookURL = server.URL
+			request := &AuthRequest{"a", "b", announce, "t", "1.2.3.4:5", http.Header{"X-Test": []string{"yes"}}}
+
+			return request, newWebhookAuthenticator(config, defaultLogger).Authenticate(request)
+		}
+
+		BeforeEach(func() {
+			calls = 0
+			received = WebhookRequest{}
+			reply = `{"decision":"allow"}`
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var request WebhookRequest
+				json.NewDecoder(r.Body).Decode(&request)
+
+				lock.Lock()
+				calls++
+				received = request
+				body := reply
+				lock.Unlock()
+
+				if body == "" {
+					time.Sleep(100 * time.Millisecond)
+				}
+				fmt.Fprint(w, body)
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("Should pass the announce to the webhook", func() {
+			_, err := authenticate(Configuration{AuthWebhookTimeout: Duration(time.Second)}, `{"id":"a","room":"b"}`)
+			Ω(err).Should(BeNil())
+
+			received := lastRequest()
+			Ω(received.Peer).Should(Equal("a"))
+			Ω(received.Room).Should(Equal("b"))
+			Ω(string(received.Announce)).Should(Equal(`{"id":"a","room":"b"}`))
+			Ω(received.Token).Should(Equal("t"))
+			Ω(received.RemoteAddress).Should(Equal("1.2.3.4:5"))
+			Ω(received.Headers.Get("X-Test")).Should(Equal("yes"))
+		})
+
+		It("Should refuse announces the webhook denies", func() {
+			respond(`{"decision":"deny","reason":"Not invited"}`)
+			_, err := authenticate(Configuration{AuthWebhookTimeout: Duration(time.Second)}, `{"id":"a","room":"b"}`)
+			Ω(err).Should(Equal(errors.New("Not invited")))
+		})
+
+		It("Should replace announces the webhook modifies", func() {
+			respond(`{"decision":"modify","announce":{"id":"a","room":"b","name":"Alice"}}`)
+			request, err := authenticate(Configuration{AuthWebhookTimeout: Duration(time.Second)}, `{"id":"a","room":"b"}`)
+			Ω(err).Should(BeNil())
+			Ω(request.Announce).Should(Equal(`{"id":"a","room":"b","name":"Alice"}`))
+		})
+
+		It("Should treat an unknown decision as a failure", func() {
+			respond(`{"decision":"maybe"}`)
+			_, err := authenticate(Configuration{AuthWebhookTimeout: Duration(time.Second)}, `{"id":"a","room":"b"}`)
+			Ω(err).ShouldNot(BeNil())
+		})
+
+		It("Should fail closed or open when the webhook doesn't respond", func() {
+			respond("")
+			auth := newWebhookAuthenticator(Configuration{AuthWebhookURL: server.URL}, defaultLogger)
+			auth.client.Timeout = 10 * time.Millisecond
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "b", Announce: `{}`})).Should(Equal(errors.New("Unable to authorize announce")))
+
+			auth.failOpen = true
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "b", Announce: `{}`})).Should(BeNil())
+		})
+
+		It("Should cache decisions", func() {
+			config := Configuration{AuthWebhookURL: server.URL, AuthWebhookTimeout: Duration(time.Second), AuthWebhookCacheTTL: Duration(time.Minute)}
+			auth := newWebhookAuthenticator(config, defaultLogger)
+
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "b", Announce: `{}`})).Should(BeNil())
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "b", Announce: `{}`})).Should(BeNil())
+			Ω(called()).Should(Equal(1))
+
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "c", Announce: `{}`})).Should(BeNil())
+			Ω(called()).Should(Equal(2))
+		})
+
+		It("Should cache decisions for a host, whatever port it connects from", func() {
+			config := Configuration{AuthWebhookURL: server.URL, AuthWebhookTimeout: Duration(time.Second), AuthWebhookCacheTTL: Duration(time.Minute)}
+			auth := newWebhookAuthenticator(config, defaultLogger)
+
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "b", Announce: `{}`, RemoteAddress: "1.2.3.4:5"})).Should(BeNil())
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "b", Announce: `{}`, RemoteAddress: "1.2.3.4:6"})).Should(BeNil())
+			Ω(called()).Should(Equal(1))
+		})
+
+		It("Should only reuse decisions for requests with the same headers", func() {
+			config := Configuration{AuthWebhookURL: server.URL, AuthWebhookTimeout: Duration(time.Second), AuthWebhookCacheTTL: Duration(time.Minute)}
+			auth := newWebhookAuthenticator(config, defaultLogger)
+
+			alice := http.Header{"Cookie": []string{"session=alice"}}
+			mallory := http.Header{"Cookie": []string{"session=mallory"}}
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "b", Announce: `{}`, RemoteAddress: "1.2.3.4:5", Header: alice})).Should(BeNil())
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "b", Announce: `{}`, RemoteAddress: "1.2.3.4:6", Header: alice})).Should(BeNil())
+			Ω(called()).Should(Equal(1))
+
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "b", Announce: `{}`, RemoteAddress: "1.2.3.4:7", Header: mallory})).Should(BeNil())
+			Ω(called()).Should(Equal(2))
+		})
+
+		It("Should drop expired decisions as new ones are cached", func() {
+			config := Configuration{AuthWebhookURL: server.URL, AuthWebhookTimeout: Duration(time.Second), AuthWebhookCacheTTL: Duration(time.Millisecond)}
+			auth := newWebhookAuthenticator(config, defaultLogger)
+
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "b", Announce: `{}`})).Should(BeNil())
+			time.Sleep(5 * time.Millisecond)
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "c", Announce: `{}`})).Should(BeNil())
+			Ω(auth.cache).Should(HaveLen(1))
+			Ω(auth.expiry.Len()).Should(Equal(1))
+		})
+
+		It("Should evict the oldest decision once the cache is full", func() {
+			config := Configuration{AuthWebhookURL: server.URL, AuthWebhookTimeout: Duration(time.Second), AuthWebhookCacheTTL: Duration(time.Minute)}
+			auth := newWebhookAuthenticator(config, defaultLogger)
+			auth.maxCache = 2
+
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "b", Announce: `{}`})).Should(BeNil())
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "c", Announce: `{}`})).Should(BeNil())
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "d", Announce: `{}`})).Should(BeNil())
+			Ω(auth.cache).Should(HaveLen(2))
+			Ω(called()).Should(Equal(3))
+
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "d", Announce: `{}`})).Should(BeNil())
+			Ω(called()).Should(Equal(3))
+			Ω(auth.Authenticate(&AuthRequest{Peer: "a", Room: "b", Announce: `{}`})).Should(BeNil())
+			Ω(called()).Should(Equal(4))
+		})
+	})
+
+	Context("Rate limiting", func() {
+		It("Should refill buckets at the configured rate", func() {
+			var b bucket
+			now := time.Now()
+
+			Ω(b.take(2, 1, now)).Should(BeTrue())
+			Ω(b.take(2, 1, now)).Should(BeTrue())
+			Ω(b.take(2, 1, now)).Should(BeFalse())
+			Ω(b.take(2, 1, now.Add(500*time.Millisecond))).Should(BeTrue())
+			Ω(b.take(2, 1, now.Add(500*time.Millisecond))).Should(BeFalse())
+			Ω(b.take(0, 100, now)).Should(BeTrue())
+		})
+
+		It("Should limit announces separately from relayed messages", func() {
+			r := newRateLimiter(Configuration{SocketAnnounceLimit: RateLimit{Messages: 1}, SocketRelayLimit: RateLimit{Bytes: 10}}, defaultLogger)
+			var s SocketLimiter
+
+			Ω(r.allow("1.2.3.4", &s, `/announce|a|{"room":"b"}`)).Should(BeTrue())
+			Ω(r.allow("1.2.3.4", &s, "/to|b|hi")).Should(BeTrue())
+			Ω(r.allow("1.2.3.4", &s, "/to|b|hi")).Should(BeFalse())
+			Ω(r.allow("1.2.3.4", &s, `/announce|a|{"room":"b"}`)).Should(BeFalse())
+		})
+
+		It("Should limit all the sockets from an address together", func() {
+			r := newRateLimiter(Configuration{AddressRelayLimit: RateLimit{Messages: 2}}, defaultLogger)
+			var s1, s2, s3 SocketLimiter
+
+			Ω(r.allow("1.2.3.4", &s1, "/to|b|hi")).Should(BeTrue())
+			Ω(r.allow("1.2.3.4", &s2, "/to|b|hi")).Should(BeTrue())
+			Ω(r.allow("1.2.3.4", &s3, "/to|b|hi")).Should(BeFalse())
+			Ω(r.allow("5.6.7.8", &s3, "/to|b|hi")).Should(BeTrue())
+		})
+
+		It("Should ban repeat offenders for longer each time", func() {
+			r := newRateLimiter(Configuration{SocketRelayLimit: RateLimit{Messages: 1}, BanDuration: Duration(10 * time.Second), MaxBanDuration: Duration(30 * time.Second)}, defaultLogger)
+			Ω(r.banned("1.2.3.4")).Should(BeFalse())
+
+			banFor := func() time.Duration {
+				var s SocketLimiter
+				r.allow("1.2.3.4", &s, "/to|b|hi")
+				Ω(r.allow("1.2.3.4", &s, "/to|b|hi")).Should(BeFalse())
+
+				return r.addresses["1.2.3.4"].bannedUntil.Sub(time.Now())
+			}
+
+			// The first offence only costs the socket its connection.
+			banFor()
+			Ω(r.banned("1.2.3.4")).Should(BeFalse())
+
+			Ω(banFor()).Should(BeNumerically("~", 10*time.Second, time.Second))
+			Ω(r.banned("1.2.3.4")).Should(BeTrue())
+			Ω(r.banned("5.6.7.8")).Should(BeFalse())
+			Ω(banFor()).Should(BeNumerically("~", 20*time.Second, time.Second))
+			Ω(banFor()).Should(BeNumerically("~", 30*time.Second, time.Second))
+		})
+
+		It("Should strip the port from remote addresses", func() {
+			Ω(remoteHost("1.2.3.4:5678")).Should(Equal("1.2.3.4"))
+			Ω(remoteHost("[::1]:5678")).Should(Equal("::1"))
+			Ω(remoteHost("")).Should(Equal(""))
+		})
+	})
+
+	Context("Reloading configuration", func() {
+		var server *Server
+
+		BeforeEach(func() {
+			config := DefaultConfiguration()
+			config.SocketTimeout = Duration(100 * time.Second)
+
+			var err error
+			server, err = NewServer(config)
+			Ω(err).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			shutdown(server)
+		})
+
+		It("Should report the settings that need a restart", func() {
+			old := Configuration{ListenAddress: ":3000", SocketTimeout: 10, AdminToken: "a"}
+			updated := Configuration{ListenAddress: ":4000", SocketTimeout: 20, AdminToken: "b"}
+
+			Ω(requiresRestart(old, updated)).Should(Equal([]string{"ListenAddress", "AdminToken"}))
+			Ω(requiresRestart(old, old)).Should(Equal([]string{}))
+			Ω(keepRestartSettings(old, updated)).Should(Equal(Configuration{ListenAddress: ":3000", SocketTimeout: 20, AdminToken: "a"}))
+		})
+
+		It("Should apply the settings that can change live", func() {
+			config := DefaultConfiguration()
+			config.ListenAddress = ":4000"
+			config.SocketTimeout = Duration(200 * time.Second)
+			config.MaxPeersPerRoom = 5
+			config.SocketRelayLimit = RateLimit{Messages: 10}
+			Ω(server.Reload(config)).Should(BeNil())
+
+			config, auth := server.live.get()
+			Ω(config.ListenAddress).Should(Equal(":3000"))
+			Ω(config.SocketTimeout).Should(Equal(Duration(200 * time.Second)))
+			Ω(auth).Should(BeNil())
+			Ω(server.limits.config.SocketRelayLimit).Should(Equal(RateLimit{Messages: 10}))
+
+			reply := inSignalBox(server.msg, func(state SignalBox) (SignalBox, adminReply) {
+				return state, adminReply{200, state.config.MaxPeersPerRoom}
+			})
+			Ω(reply.body).Should(Equal(5))
+		})
+
+		It("Should keep the current configuration if the new one is invalid", func() {
+			config := DefaultConfiguration()
+			config.SocketTimeout = Duration(-1)
+			Ω(server.Reload(config)).ShouldNot(BeNil())
+
+			config, _ = server.live.get()
+			Ω(config.SocketTimeout).Should(Equal(Duration(100 * time.Second)))
+		})
+	})
+
+	Context("Embedding", func() {
+		It("Should refuse an invalid configuration", func() {
+			config := DefaultConfiguration()
+			config.OutboundQueueSize = 0
+
+			_, err := NewServer(config)
+			Ω(err).ShouldNot(BeNil())
+		})
+
+		It("Should serve websockets from an existing mux", func() {
+			server, err := NewServer(DefaultConfiguration())
+			Ω(err).Should(BeNil())
+			defer shutdown(server)
+
+			mux := http.NewServeMux()
+			mux.Handle("/signal", server)
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/signal", nil)
+			Ω(err).Should(BeNil())
+			defer ws.Close()
+
+			socketSend(ws, "/announce|embedded|{\"room\":\"embedded-room\"}")
+			socketShouldContain(ws, "/roominfo|{\"memberCount\":1,\"members\":[]}")
+		})
+
+		It("Should stop the signalbox once shut down", func() {
+			server, err := NewServer(DefaultConfiguration())
+			Ω(err).Should(BeNil())
+			shutdown(server)
+
+			reply := inSignalBox(server.msg, func(state SignalBox) (SignalBox, adminReply) {
+				return state, adminReply{200, nil}
+			})
+			Ω(reply.status).Should(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("Should keep the logging and metrics of each server apart", func() {
+			first, err := NewServer(DefaultConfiguration())
+			Ω(err).Should(BeNil())
+			defer shutdown(first)
+
+			second, err := NewServer(DefaultConfiguration())
+			Ω(err).Should(BeNil())
+			defer shutdown(second)
+
+			a, err := connectPeer(first, "a", "test")
+			Ω(err).Should(BeNil())
+			var reply string
+			Eventually(a.Messages()).Should(Receive(&reply))
+
+			metrics := func(server *Server) string {
+				res := httptest.NewRecorder()
+				server.metrics.ServeHTTP(res, nil)
+				return res.Body.String()
+			}
+			Ω(metrics(first)).Should(ContainSubstring("signalbox_peers 1\n"))
+			Ω(metrics(second)).Should(ContainSubstring("signalbox_peers 0\n"))
+
+			config := DefaultConfiguration()
+			config.LogLevel = "error"
+			Ω(first.Reload(config)).Should(BeNil())
+			Ω(first.logger.level).ShouldNot(Equal(second.logger.level))
+			Ω(first.Logger()).Should(BeIdenticalTo(first.logger))
+		})
+
+		It("Should stop listening once shut down", func() {
+			config := DefaultConfiguration()
+			config.ListenAddress = "127.0.0.1:3011"
+			server, err := NewServer(config)
+			Ω(err).Should(BeNil())
+			Ω(server.Start()).Should(BeNil())
+
+			res, err := http.Get("http://127.0.0.1:3011/rtc.io/primus.js")
+			Ω(err).Should(BeNil())
+			res.Body.Close()
+			Ω(res.StatusCode).Should(Equal(200))
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			Ω(server.Shutdown(ctx)).Should(BeNil())
+
+			_, err = http.Get("http://127.0.0.1:3011/rtc.io/primus.js")
+			Ω(err).ShouldNot(BeNil())
+		})
+	})
+
+	Context("Outbound queues", func() {
+		var config Configuration
+
+		BeforeEach(func() {
+			config, _ = parseConfiguration("foo")
+			config.OutboundQueueSize = 2
+		})
+
+		It("Should drop the oldest message when using the drop-oldest policy", func() {
+			config.OutboundQueuePolicy = DropOldest
+			c := newConnection(config, nil)
+			Ω(c.Write([]byte("1"))).Should(BeNil())
+			Ω(c.Write([]byte("2"))).Should(BeNil())
+			Ω(c.Write([]byte("3"))).Should(BeNil())
+
+			Ω(string(<-c.outbound)).Should(Equal("2"))
+			Ω(string(<-c.outbound)).Should(Equal("3"))
+		})
+
+		It("Should drop the newest message when using the drop-newest policy", func() {
+			config.OutboundQueuePolicy = DropNewest
+			c := newConnection(config, nil)
+			Ω(c.Write([]byte("1"))).Should(BeNil())
+			Ω(c.Write([]byte("2"))).Should(BeNil())
+			Ω(c.Write([]byte("3"))).ShouldNot(BeNil())
+
+			Ω(string(<-c.outbound)).Should(Equal("1"))
+			Ω(string(<-c.outbound)).Should(Equal("2"))
+		})
+
+		It("Should close the connection when using the disconnect policy", func() {
+			config.OutboundQueuePolicy = Disconnect
+			c := newConnection(config, nil)
+			Ω(c.Write([]byte("1"))).Should(BeNil())
+			Ω(c.Write([]byte("2"))).Should(BeNil())
+			Ω(c.Write([]byte("3"))).ShouldNot(BeNil())
+
+			Eventually(c.closed).Should(BeClosed())
+			Ω(c.Write([]byte("4"))).ShouldNot(BeNil())
+		})
+	})
+
+	Context("Broadcast messages", func() {
+		var server *Server
+
+		// Spin up a fresh signalbox for each spec, with peers connected in memory.
+		BeforeEach(func() {
+			server, _ = NewServer(DefaultConfiguration())
+		})
+
+		AfterEach(func() {
+			shutdown(server)
+		})
+
+		It("Should be to send announce and leave messages to peers", func() {
+			a, err := connectPeer(server, "a", "test-room")
+			Ω(err).Should(BeNil())
+			peerShouldReceive(a, "/roominfo|{\"memberCount\":1,\"members\":[]}")
+
+			b, err := connectPeer(server, "b", "test-room")
+			Ω(err).Should(BeNil())
+			peerShouldReceive(b, "/roominfo|{\"memberCount\":2,\"members\":[{\"id\":\"a\",\"data\":{\"room\":\"test-room\"}}]}")
+
+			peerShouldReceive(a, "/announce|b|{\"room\":\"test-room\"}")
+
+			peerSend(a, "/leave|a|{\"room\":\"test-room\"}")
+			err = a.Close()
+			Ω(err).Should(BeNil())
+
+			peerShouldReceive(b, "/leave|a|{\"room\":\"test-room\"}")
+			err = b.Close()
+			Ω(err).Should(BeNil())
+		})
+
+		It("Should be able to send messages just to specified recipients", func() {
+			a2, err := connectPeer(server, "a2", "to-test")
+			Ω(err).Should(BeNil())
+			peerShouldReceive(a2, "/roominfo|{\"memberCount\":1,\"members\":[]}")
+
+			b2, err := connectPeer(server, "b2", "to-test")
+			Ω(err).Should(BeNil())
+			peerShouldReceive(b2, "/roominfo|{\"memberCount\":2,\"members\":[{\"id\":\"a2\",\"data\":{\"room\":\"to-test\"}}]}")
+
+			c2, err := connectPeer(server, "c2", "to-test")
+			Ω(err).Should(BeNil())
+			peerShouldReceive(c2, "/roominfo|{\"memberCount\":3,\"members\":[{\"id\":\"a2\",\"data\":{\"room\":\"to-test\"}},{\"id\":\"b2\",\"data\":{\"room\":\"to-test\"}}]}")
+
+			peerShouldReceive(a2, "/announce|b2|{\"room\":\"to-test\"}")
+			peerShouldReceive(a2, "/announce|c2|{\"room\":\"to-test\"}")
+
+			peerShouldReceive(b2, "/announce|c2|{\"room\":\"to-test\"}")
+			peerSend(a2, "/to|c2|/hello|{\"id\":\"a2\"}")
+
+			peerShouldReceive(c2, "/to|c2|/hello|{\"id\":\"a2\"}")
+
+			Consistently(b2.Messages(), "100ms").ShouldNot(Receive())
+		})
+
+		It("Should be able to send custom messages to peers", func() {
+			a3, err := connectPeer(server, "a3", "custom-test")
+			Ω(err).Should(BeNil())
+			peerShouldReceive(a3, "/roominfo|{\"memberCount\":1,\"members\":[]}")
+
+			b3, err := connectPeer(server, "b3", "custom-test")
+			Ω(err).Should(BeNil())
+			peerShouldReceive(b3, "/roominfo|{\"memberCount\":2,\"members\":[{\"id\":\"a3\",\"data\":{\"room\":\"custom-test\"}}]}")
+
+			peerShouldReceive(a3, "/announce|b3|{\"room\":\"custom-test\"}")
+			peerSend(a3, "/hello|a3")
+			peerShouldReceive(b3, "/hello|a3")
+		})
+
+		It("Should get a leave message when a peer disconnects", func() {
+			a4, err := connectPeer(server, "a4", "close-test")
+			Ω(err).Should(BeNil())
+			peerShouldReceive(a4, "/roominfo|{\"memberCount\":1,\"members\":[]}")
+
+			b4, err := connectPeer(server, "b4", "close-test")
+			Ω(err).Should(BeNil())
+			peerShouldReceive(b4, "/roominfo|{\"memberCount\":2,\"members\":[{\"id\":\"a4\",\"data\":{\"room\":\"close-test\"}}]}")
+
+			peerShouldReceive(a4, "/announce|b4|{\"room\":\"close-test\"}")
+			err = a4.Close()
+			Ω(err).Should(BeNil())
+			peerShouldReceive(b4, "/leave|a4|{\"room\":\"close-test\"}")
+		})
+
+		It("Should be able to handle very long messages", func() {
+			a5, err := connectPeer(server, "a5", "long-test")
+			Ω(err).Should(BeNil())
+			peerShouldReceive(a5, "/roominfo|{\"memberCount\":1,\"members\":[]}")
+
+			b5, err := connectPeer(server, "b5", "long-test")
+			peerShouldReceive(b5, "/roominfo|{\"memberCount\":2,\"members\":[{\"id\":\"a5\",\"data\":{\"room\":\"long-test\"}}]}")
+
+			peerShouldReceive(a5, "/announce|b5|{\"room\":\"long-test\"}")
+
+			peerSend(b5, "/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa|b5")
+
+			peerShouldReceive(a5, "/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa|b5")
+		})
+
+		It("Should refuse in-memory connections from banned addresses", func() {
+			server.limits.lock.Lock()
+			server.limits.addresses["10.0.0.1"] = &addressState{bannedUntil: time.Now().Add(time.Minute)}
+			server.limits.lock.Unlock()
+
+			c := server.Connect("10.0.0.1:1234")
+			peerShouldReceive(c, "/error|{\"code\":\"rate-limited\",\"command\":\"connect\",\"message\":\"Address is banned for exceeding rate limits\"}")
+			Eventually(c.Messages()).Should(BeClosed())
+		})
+
+		It("Should tell peers why they were disconnected", func() {
+			a6, err := connectPeer(server, "a6", "going-away-test")
+			Ω(err).Should(BeNil())
+			peerShouldReceive(a6, "/roominfo|{\"memberCount\":1,\"members\":[]}")
+
+			inSignalBox(server.msg, func(state SignalBox) (SignalBox, adminReply) {
+				state.Peers["a6"].socket.CloseGoingAway("Signalbox is shutting down")
+				return state, adminReply{200, nil}
+			})
+
+			Eventually(a6.Messages()).Should(BeClosed())
+			code, reason := a6.CloseStatus()
+			Ω(code).Should(Equal(CloseGoingAway))
+			Ω(reason).Should(Equal("Signalbox is shutting down"))
+		})
+	})
+})
+
+func socketSend(ws *websocket.Conn, content string) {
+	ws.WriteMessage(websocket.TextMessage, []byte(content))
+}
+
+func socketShouldContain(ws *websocket.Conn, content string) {
+	_, message, err := ws.ReadMessage()
+	Ω(err).Should(BeNil())
+	Ω(string(message)).Should(Equal(content))
+}
+
+// shutdown stops server without waiting for its rooms to empty.
+func shutdown(server *Server) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	server.Shutdown(ctx)
+}
+
+func peerSend(conn *MemoryConn, content string) {
+	Ω(conn.Send(content)).Should(BeNil())
+}
+
+func peerShouldReceive(conn *MemoryConn, content string) {
+	var message string
+	Eventually(conn.Messages()).Should(Receive(&message))
+	Ω(message).Should(Equal(content))
+}
+
+func connectPeer(server *Server, id string, room string) (*MemoryConn, error) {
+	conn := server.Connect("127.0.0.1:0")
+
+	connect := fmt.Sprintf("/announce|%s|{\"room\":\"%s\"}", id, room)
+	err := conn.Send(connect)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func writeCertificate(commonName string, certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Ω(err).Should(BeNil())
+
+	template := x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:   pkix.Name{CommonName: commonName},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour)}
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	Ω(err).Should(BeNil())
+
+	der, err := x509.MarshalECPrivateKey(key)
+	Ω(err).Should(BeNil())
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+func encodeSegment(b []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(b), "=")
+}
+
+func signHS256(secret []byte, claims string) string {
+	signed := encodeSegment([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encodeSegment([]byte(claims))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+
+	return signed + "." + encodeSegment(mac.Sum(nil))
+}
+
+func signES256(key *ecdsa.PrivateKey, claims string) string {
+	signed := encodeSegment([]byte(`{"alg":"ES256","typ":"JWT"}`)) + "." + encodeSegment([]byte(claims))
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	Ω(err).Should(BeNil())
 
-	res.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	signature := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rb):32], rb)
+	copy(signature[64-len(sb):], sb)
 
-	return res, nil
+	return signed + "." + encodeSegment(signature)
 }
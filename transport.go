@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"time"
+)
+
+const bufferSize int = 2048
+const maxMessageSize int = 20480 // Ensure that inbound messages don't cause the signalbox to run out of memory.
+
+// The status codes sent to a peer when its connection is closed.
+const (
+	CloseNormal    int = 1000 // The connection has finished with.
+	CloseGoingAway int = 1001 // The signalbox is shutting down, or being drained.
+)
+
+// Transport carries messages between a single peer and the signalbox. Only one goroutine reads
+// from a Transport, and only one writes to it.
+type Transport interface {
+	// ReadMessage blocks until the next message from the peer arrives. A MessageError skips
+	// just the one message, any other error means the transport is finished with.
+	ReadMessage() (string, error)
+
+	// SetReadDeadline sets how long ReadMessage may wait for the next message.
+	SetReadDeadline(deadline time.Time) error
+
+	// WriteMessage sends message to the peer, giving up at deadline.
+	WriteMessage(message []byte, deadline time.Time) error
+
+	// Close tells the peer why the connection is being closed (with a code like CloseNormal)
+	// and then closes the transport.
+	Close(code int, reason string, deadline time.Time) error
+
+	// RemoteAddr returns where the peer is connecting from.
+	RemoteAddr() string
+}
+
+// MessageError is returned by ReadMessage when a message can't be read, but the transport
+// is still usable.
+type MessageError struct {
+	Err error // Why the message couldn't be read.
+}
+
+func (e MessageError) Error() string {
+	return e.Err.Error()
+}
+
+// websocketTransport carries messages over a gorilla websocket.
+type websocketTransport struct {
+	ws *websocket.Conn
+}
+
+func newWebsocketTransport(ws *websocket.Conn) Transport {
+	return &websocketTransport{ws}
+}
+
+func (t *websocketTransport) ReadMessage() (string, error) {
+	_, reader, err := t.ws.NextReader()
+	if err != nil {
+		return "", err
+	}
+
+	buffer := make([]byte, bufferSize)
+	n, err := reader.Read(buffer)
+	contents := string(buffer[0:n])
+
+	for err != io.EOF && (len(contents)-bufferSize) < maxMessageSize {
+		// filled the buffer - we might have more stuff in the message.
+		n, err = reader.Read(buffer)
+		contents = contents + string(buffer[0:n])
+	}
+
+	if err == nil {
+		return "", MessageError{errors.New(fmt.Sprintf("Message is longer than %d bytes", maxMessageSize))}
+	}
+
+	if err != io.EOF {
+		return "", MessageError{err}
+	}
+
+	return contents, nil
+}
+
+func (t *websocketTransport) SetReadDeadline(deadline time.Time) error {
+	return t.ws.SetReadDeadline(deadline)
+}
+
+func (t *websocketTransport) WriteMessage(message []byte, deadline time.Time) error {
+	t.ws.SetWriteDeadline(deadline)
+	return t.ws.WriteMessage(websocket.TextMessage, message)
+}
+
+func (t *websocketTransport) Close(code int, reason string, deadline time.Time) error {
+	frame := websocket.FormatCloseMessage(code, reason)
+	t.ws.WriteControl(websocket.CloseMessage, frame, deadline)
+
+	return t.ws.Close()
+}
+
+func (t *websocketTransport) RemoteAddr() string {
+	return t.ws.RemoteAddr().String()
+}
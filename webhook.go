@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) Clinton Freeman 2014
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+ * associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute,
+ * sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+ * NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+ * DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package signalbox
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The decisions an authorization webhook can make about an announce.
+const (
+	Allow  string = "allow"  // Let the announce through unchanged.
+	Deny   string = "deny"   // Refuse the announce.
+	Modify string = "modify" // Let the announce through, replacing it with the one in the response.
+)
+
+// The most decisions that are cached, the oldest are evicted to make room for new ones.
+const webhookCacheMaxSize int = 4096
+
+type WebhookRequest struct {
+	Peer          string          `json:"peer"`          // The id the peer is announcing as.
+	Room          string          `json:"room"`          // The room the peer is announcing into.
+	Announce      json.RawMessage `json:"announce"`      // The JSON the peer is announcing with.
+	Token         string          `json:"token"`         // The token the peer supplied, if any.
+	RemoteAddress string          `json:"remoteAddress"` // Where the peer is connecting from.
+	Headers       http.Header     `json:"headers"`       // The headers of the request that opened the websocket.
+}
+
+type WebhookResponse struct {
+	Decision string          `json:"decision"` // One of allow, deny or modify.
+	Reason   string          `json:"reason"`   // Why the announce was denied, passed on to the peer.
+	Announce json.RawMessage `json:"announce"` // The replacement announce for a modify decision.
+}
+
+type cachedDecision struct {
+	key      string          // The key the decision is cached under.
+	response WebhookResponse // The decision the webhook made.
+	expires  time.Time       // When the decision needs to be asked for again.
+}
+
+// WebhookAuthenticator asks an external HTTP service whether each announce may proceed.
+type WebhookAuthenticator struct {
+	lock     sync.Mutex
+	url      string                   // Where announces are POSTed for a decision.
+	client   *http.Client             // The client used to call the webhook, which carries the timeout.
+	failOpen bool                     // Allow announces when the webhook can't be reached?
+	cacheTTL time.Duration            // How long decisions are cached, zero disables the cache.
+	cache    map[string]*list.Element // Recent decisions, keyed by the announce they were made for.
+	expiry   *list.List               // The cached decisions, from the first to expire to the last.
+	maxCache int                      // The most decisions that are kept in the cache.
+	logger   *Logger                  // Where webhook failures are logged.
+}
+
+func newWebhookAuthenticator(config Configuration, logger *Logger) *WebhookAuthenticator {
+	return &WebhookAuthenticator{url: config.AuthWebhookURL,
+		client:   &http.Client{Timeout: time.Duration(config.AuthWebhookTimeout)},
+		failOpen: config.AuthWebhookFailOpen,
+		cacheTTL: time.Duration(config.AuthWebhookCacheTTL),
+		cache:    make(map[string]*list.Element),
+		expiry:   list.New(),
+		maxCache: webhookCacheMaxSize,
+		logger:   logger}
+}
+
+func (a *WebhookAuthenticator) Authenticate(request *AuthRequest) error {
+	key := cacheKey(request)
+
+	response, cached := a.cached(key)
+	if !cached {
+		var err error
+		response, err = a.call(request)
+		if err != nil {
+			if a.failOpen {
+				a.logger.Warn("Authorization webhook failed - allowing announce", "peer", request.Peer, "err", err)
+				return nil
+			}
+
+			a.logger.Warn("Authorization webhook failed - denying announce", "peer", request.Peer, "err", err)
+			return errors.New("Unable to authorize announce")
+		}
+
+		a.store(key, response)
+	}
+
+	switch response.Decision {
+	case Allow:
+		return nil
+
+	case Modify:
+		request.Announce = string(response.Announce)
+		return nil
+
+	default:
+		if response.Reason != "" {
+			return errors.New(response.Reason)
+		}
+		return errors.New("Announce denied")
+	}
+}
+
+// cacheKey identifies everything the webhook is shown about request, including the headers
+// (like cookies) that might decide who the peer is. The port changes with every connection,
+// so only the host is part of the key.
+func cacheKey(request *AuthRequest) string {
+	h := sha256.New()
+	io.WriteString(h, strings.Join([]string{request.Peer, request.Room, request.Token, remoteHost(request.RemoteAddress), request.Announce}, "|"))
+	request.Header.Write(h)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// call POSTs request to the webhook and returns its decision.
+func (a *WebhookAuthenticator) call(request *AuthRequest) (WebhookResponse, error) {
+	var response WebhookResponse
+
+	b, err := json.Marshal(WebhookRequest{request.Peer,
+		request.Room,
+		json.RawMessage(request.Announce),
+		request.Token,
+		request.RemoteAddress,
+		request.Header})
+	if err != nil {
+		return response, err
+	}
+
+	res, err := a.client.Post(a.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return response, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return response, errors.New(fmt.Sprintf("Webhook returned %s", res.Status))
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return response, err
+	}
+
+	switch response.Decision {
+	case Allow, Deny:
+	case Modify:
+		var announce map[string]interface{}
+		if json.Unmarshal(response.Announce, &announce) != nil {
+			return response, errors.New("Webhook modified the announce into invalid JSON")
+		}
+	default:
+		return response, errors.New(fmt.Sprintf("Webhook returned unknown decision %s", response.Decision))
+	}
+
+	return response, nil
+}
+
+func (a *WebhookAuthenticator) cached(key string) (WebhookResponse, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	e, exists := a.cache[key]
+	if !exists || time.Now().After(e.Value.(cachedDecision).expires) {
+		return WebhookResponse{}, false
+	}
+
+	return e.Value.(cachedDecision).response, true
+}
+
+func (a *WebhookAuthenticator) store(key string, response WebhookResponse) {
+	if a.cacheTTL <= 0 {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if e, exists := a.cache[key]; exists {
+		a.evict(e)
+	}
+
+	// Every decision lives for the same TTL, so the oldest is always the first to expire.
+	now := time.Now()
+	for e := a.expiry.Front(); e != nil; e = a.expiry.Front() {
+		if len(a.cache) < a.maxCache && !now.After(e.Value.(cachedDecision).expires) {
+			break
+		}
+		a.evict(e)
+	}
+
+	a.cache[key] = a.expiry.PushBack(cachedDecision{key, response, now.Add(a.cacheTTL)})
+}
+
+// evict removes the cached decision e.
+func (a *WebhookAuthenticator) evict(e *list.Element) {
+	delete(a.cache, e.Value.(cachedDecision).key)
+	a.expiry.Remove(e)
+}